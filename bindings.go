@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"gitlab.com/gomidi/midi/v2"
+
+	"huemidi/hue"
+	"huemidi/midimap"
+)
+
+// Supported values for Binding.Match.
+const (
+	MatchNote    = "note"
+	MatchCC      = "cc"
+	MatchProgram = "program"
+)
+
+// Supported values for Binding.Action.
+const (
+	// ActionBrightness sets Params.Value, or without it follows the
+	// velocity of a note or the value of a CC.
+	ActionBrightness = "brightness"
+	// ActionScene recalls Params.Scene, by name or ID.
+	ActionScene = "scene"
+	// ActionFlash flashes the lights with Params.Alert, see the hue.Alert*
+	// constants.
+	ActionFlash = "flash"
+)
+
+// Binding ties one MIDI message to an action in a bindings file.
+type Binding struct {
+	Match  string        `json:"match"`
+	Number int           `json:"number"`
+	Action string        `json:"action"`
+	Params BindingParams `json:"params"`
+
+	// scene is Params.Scene looked up on the bridge.
+	scene hue.Scene
+}
+
+// BindingParams holds the settings of an action, only the ones relevant
+// to it are used.
+type BindingParams struct {
+	Value *int   `json:"value,omitempty"`
+	Scene string `json:"scene,omitempty"`
+	Alert string `json:"alert,omitempty"`
+}
+
+// BindingsFile is the format of the file given with -bindings.
+type BindingsFile struct {
+	Bindings []Binding `json:"bindings"`
+}
+
+// bindingKey identifies the message a binding matches.
+type bindingKey struct {
+	match  string
+	number uint8
+}
+
+// loadBindings reads and validates a bindings file.
+func loadBindings(path string) ([]Binding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bindings: %v", err)
+	}
+
+	var file BindingsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse bindings %s: %v", path, err)
+	}
+
+	seen := make(map[bindingKey]bool)
+	for i := range file.Bindings {
+		binding := &file.Bindings[i]
+		if err := binding.validate(); err != nil {
+			return nil, fmt.Errorf("binding %d: %v", i+1, err)
+		}
+
+		key := bindingKey{binding.Match, uint8(binding.Number)}
+		if seen[key] {
+			return nil, fmt.Errorf("binding %d: %s %d is bound twice", i+1, binding.Match, binding.Number)
+		}
+		seen[key] = true
+	}
+
+	return file.Bindings, nil
+}
+
+func (b *Binding) validate() error {
+	switch b.Match {
+	case MatchNote, MatchCC, MatchProgram:
+	default:
+		return fmt.Errorf("invalid match %q: expected %s, %s or %s", b.Match, MatchNote, MatchCC, MatchProgram)
+	}
+	if b.Number < 0 || b.Number > 127 {
+		return fmt.Errorf("invalid number %d: expected 0-127", b.Number)
+	}
+
+	switch b.Action {
+	case ActionBrightness:
+		if value := b.Params.Value; value != nil && (*value < 0 || *value > 100) {
+			return fmt.Errorf("invalid brightness %d: expected 0-100", *value)
+		}
+		if b.Params.Value == nil && b.Match == MatchProgram {
+			return fmt.Errorf("a program change has no value to follow, set params.value")
+		}
+	case ActionScene:
+		if b.Params.Scene == "" {
+			return fmt.Errorf("scene action without params.scene")
+		}
+	case ActionFlash:
+		switch b.Params.Alert {
+		case "":
+			b.Params.Alert = hue.AlertSelect
+		case hue.AlertSelect, hue.AlertLSelect:
+		default:
+			return fmt.Errorf("invalid alert %q: expected %s or %s", b.Params.Alert, hue.AlertSelect, hue.AlertLSelect)
+		}
+	default:
+		return fmt.Errorf("invalid action %q: expected %s, %s or %s", b.Action, ActionBrightness, ActionScene, ActionFlash)
+	}
+
+	return nil
+}
+
+// describe sums up the action, for display.
+func (b *Binding) describe() string {
+	switch b.Action {
+	case ActionBrightness:
+		if b.Params.Value != nil {
+			return fmt.Sprintf("%d%% brightness", *b.Params.Value)
+		}
+		return "0-100% brightness"
+	case ActionScene:
+		return "scene " + b.scene.Name
+	default:
+		return "flash"
+	}
+}
+
+// bindsScenes reports whether any binding recalls a scene.
+func bindsScenes(bindings []Binding) bool {
+	for _, binding := range bindings {
+		if binding.Action == ActionScene {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBindingScenes looks up the scenes of the scene bindings.
+func resolveBindingScenes(scenes []hue.Scene, bindings []Binding) error {
+	for i := range bindings {
+		binding := &bindings[i]
+		if binding.Action != ActionScene {
+			continue
+		}
+
+		resolved, err := resolveScenes(scenes, map[uint8]string{0: binding.Params.Scene})
+		if err != nil {
+			return fmt.Errorf("%s %d: %v", binding.Match, binding.Number, err)
+		}
+		binding.scene = resolved[0]
+	}
+	return nil
+}
+
+// indexBindings makes the bindings quick to find for each message.
+func indexBindings(bindings []Binding) map[bindingKey]*Binding {
+	index := make(map[bindingKey]*Binding, len(bindings))
+	for i := range bindings {
+		index[bindingKey{bindings[i].Match, uint8(bindings[i].Number)}] = &bindings[i]
+	}
+	return index
+}
+
+// handleBinding runs the action bound to a message, if any. Note releases
+// and unbound messages are ignored.
+func (l *midiListener) handleBinding(msg midi.Message) {
+	var channel, key, vel, controller, value, program uint8
+
+	var binding *Binding
+	var input int
+	switch {
+	case msg.GetNoteOn(&channel, &key, &vel) && vel > 0:
+		midiNotesTotal.Add(1)
+		binding, input = l.bindings[bindingKey{MatchNote, key}], midimap.VelocityBrightness(vel)
+	case msg.GetControlChange(&channel, &controller, &value):
+		binding, input = l.bindings[bindingKey{MatchCC, controller}], midimap.CCBrightness(value)
+	case msg.GetProgramChange(&channel, &program):
+		binding = l.bindings[bindingKey{MatchProgram, program}]
+	}
+	if binding == nil {
+		return
+	}
+
+	switch binding.Action {
+	case ActionBrightness:
+		brightness := input
+		if binding.Params.Value != nil {
+			brightness = *binding.Params.Value
+		}
+		l.setBrightness(brightness)
+		slog.Info(fmt.Sprintf("🎛️  %s %d → %d%% brightness", binding.Match, binding.Number, brightness))
+	case ActionScene:
+		l.recallScene(binding.scene)
+		slog.Info(fmt.Sprintf("🎬 %s %d → scene %s", binding.Match, binding.Number, binding.scene.Name))
+	case ActionFlash:
+		l.sendAll(func(ctx context.Context, light *hue.Light) error {
+			return l.client.WithContext(ctx).Alert(light, binding.Params.Alert)
+		})
+		slog.Info(fmt.Sprintf("⚡ %s %d → flash", binding.Match, binding.Number))
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"huemidi/hue"
+)
+
+// chordSettle is how long the held notes have to stay the same before
+// they count as a chord, since the notes of a chord never land at exactly
+// the same time.
+const chordSettle = 80 * time.Millisecond
+
+// chordIntervals are the chord qualities understood by -chords, as
+// semitones above the root.
+var chordIntervals = map[string][]int{
+	"":     {0, 4, 7},
+	"m":    {0, 3, 7},
+	"dim":  {0, 3, 6},
+	"aug":  {0, 4, 8},
+	"sus2": {0, 2, 7},
+	"sus4": {0, 5, 7},
+	"7":    {0, 4, 7, 10},
+	"maj7": {0, 4, 7, 11},
+	"m7":   {0, 3, 7, 10},
+}
+
+// noteClasses are the pitch classes of the natural notes.
+var noteClasses = map[byte]int{'C': 0, 'D': 2, 'E': 4, 'F': 5, 'G': 7, 'A': 9, 'B': 11}
+
+// pitchSet is a set of pitch classes, bit 0 being C. Chords match in any
+// octave and inversion.
+type pitchSet uint16
+
+// ChordAction is what playing a chord does: recall a scene, or set a
+// color temperature or a hue on the lights.
+type ChordAction struct {
+	// Chord is the name the chord was given as, e.g. "Am".
+	Chord string
+	// Scene is a scene name or ID, empty for colors.
+	Scene string
+	// Mireds is a color temperature, Hue a hue on the color wheel, each
+	// -1 when unused.
+	Mireds int
+	Hue    int
+
+	// scene is Scene looked up on the bridge.
+	scene hue.Scene
+}
+
+// parseChordBindings parses a list of chord=action pairs such as
+// "C=ct:2700,Am=hue:46000,F=Relax". Chords are a root note (C, F#, Bb...)
+// followed by a quality from chordIntervals. Actions are ct:<kelvin>,
+// hue:<0-65535>, or a scene by name or ID.
+func parseChordBindings(value string) (map[pitchSet]*ChordAction, error) {
+	bindings := make(map[pitchSet]*ChordAction)
+	if value == "" {
+		return bindings, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		chord, action, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || action == "" {
+			return nil, fmt.Errorf("expected chord=action, got %q", pair)
+		}
+		set, err := parseChord(chord)
+		if err != nil {
+			return nil, err
+		}
+		if previous, ok := bindings[set]; ok {
+			return nil, fmt.Errorf("%s and %s are the same chord", previous.Chord, chord)
+		}
+
+		binding := &ChordAction{Chord: chord, Mireds: -1, Hue: -1}
+		switch {
+		case strings.HasPrefix(action, "ct:"):
+			kelvin, err := strconv.Atoi(strings.TrimPrefix(action, "ct:"))
+			if err != nil || kelvin <= 0 {
+				return nil, fmt.Errorf("%s: color temperature %q should be in kelvin, e.g. ct:2700", chord, action)
+			}
+			binding.Mireds = min(max(1000000/kelvin, hue.MinColorTemp), hue.MaxColorTemp)
+		case strings.HasPrefix(action, "hue:"):
+			h, err := strconv.Atoi(strings.TrimPrefix(action, "hue:"))
+			if err != nil || h < 0 || h > hue.MaxHue {
+				return nil, fmt.Errorf("%s: hue %q should be between 0 and %d", chord, action, hue.MaxHue)
+			}
+			binding.Hue = h
+		default:
+			binding.Scene = action
+		}
+		bindings[set] = binding
+	}
+
+	return bindings, nil
+}
+
+// parseChord returns the pitch classes of a chord name such as "C", "F#m"
+// or "Bbmaj7".
+func parseChord(name string) (pitchSet, error) {
+	if name == "" {
+		return 0, fmt.Errorf("empty chord name")
+	}
+	root, ok := noteClasses[name[0]]
+	if !ok {
+		return 0, fmt.Errorf("chord %q should start with a note from A to G", name)
+	}
+	quality := name[1:]
+	switch {
+	case strings.HasPrefix(quality, "#"):
+		root, quality = root+1, quality[1:]
+	case strings.HasPrefix(quality, "b"):
+		root, quality = root+11, quality[1:]
+	}
+
+	intervals, ok := chordIntervals[quality]
+	if !ok {
+		return 0, fmt.Errorf("chord %q has an unknown quality %q, expected one of major (none), m, dim, aug, sus2, sus4, 7, maj7 or m7", name, quality)
+	}
+	var set pitchSet
+	for _, interval := range intervals {
+		set |= 1 << ((root + interval) % 12)
+	}
+	return set, nil
+}
+
+// chordsScenes reports whether any chord recalls a scene.
+func chordsScenes(chords map[pitchSet]*ChordAction) bool {
+	for _, chord := range chords {
+		if chord.Scene != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveChordScenes looks up the scenes of the chords recalling one.
+func resolveChordScenes(scenes []hue.Scene, chords map[pitchSet]*ChordAction) error {
+	for _, chord := range chords {
+		if chord.Scene == "" {
+			continue
+		}
+
+		resolved, err := resolveScenes(scenes, map[uint8]string{0: chord.Scene})
+		if err != nil {
+			return fmt.Errorf("chord %s: %v", chord.Chord, err)
+		}
+		chord.scene = resolved[0]
+	}
+	return nil
+}
+
+// describe tells what the chord does, for the startup summary.
+func (c *ChordAction) describe() string {
+	switch {
+	case c.Scene != "":
+		return "scene " + c.scene.Name
+	case c.Mireds >= 0:
+		return fmt.Sprintf("%dK", 1000000/c.Mireds)
+	default:
+		return fmt.Sprintf("hue %d", c.Hue)
+	}
+}
+
+// trackChord records a key going down or up. Once the held keys settle,
+// detectChord runs the action of the chord they make, if any.
+func (l *midiListener) trackChord(key uint8, down bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if down {
+		l.heldKeys[key] = true
+	} else {
+		delete(l.heldKeys, key)
+	}
+
+	// Only pressing a key can complete a chord, releasing one while the
+	// chord settles cancels it
+	if l.chordTimer != nil {
+		l.chordTimer.Stop()
+	}
+	if down {
+		l.chordTimer = time.AfterFunc(chordSettle, l.detectChord)
+	}
+}
+
+func (l *midiListener) detectChord() {
+	l.mu.Lock()
+	var set pitchSet
+	for key := range l.heldKeys {
+		set |= 1 << (key % 12)
+	}
+	l.mu.Unlock()
+
+	chord, ok := l.opts.Chords[set]
+	if !ok {
+		return
+	}
+
+	switch {
+	case chord.Scene != "":
+		l.recallScene(chord.scene)
+	case chord.Mireds >= 0:
+		for _, light := range l.currentLights() {
+			if light.SupportsColorTemp {
+				l.update(light, hue.ColorTempUpdate(chord.Mireds))
+			}
+		}
+	default:
+		for _, light := range l.currentLights() {
+			if light.SupportsColor {
+				l.update(light, hue.ColorUpdate(chord.Hue, hue.MaxSat))
+			}
+		}
+	}
+	slog.Info(fmt.Sprintf("🎼 Chord %s → %s", chord.Chord, chord.describe()))
+}
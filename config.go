@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config is the state persisted between runs in the user's config directory.
+type Config struct {
+	IP string `json:"ip,omitempty"`
+	// BridgeID and Port come from discovery, the ID finds the bridge
+	// again if its IP changes.
+	BridgeID string `json:"bridge_id,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	// ClientKey goes with Username. Only v2 bridges hand it out, it is
+	// needed for the entertainment streaming API.
+	ClientKey   string             `json:"clientkey,omitempty"`
+	Calibration *CalibrationConfig `json:"calibration,omitempty"`
+	// Lights and Mode are saved by huemidi setup. Lights are light.Key()
+	// values, so rooms and zones picked as a whole come back too.
+	Lights []string `json:"lights,omitempty"`
+	Mode   string   `json:"mode,omitempty"`
+
+	// profile is the -profile the config was loaded from and is saved to.
+	profile string
+}
+
+// defaultProfile is the profile of the top-level fields of the config
+// file, the only one before profiles existed.
+const defaultProfile = "default"
+
+// configFile is the config file: the default profile, and the others by
+// name.
+type configFile struct {
+	Config
+	Profiles map[string]*Config `json:"profiles,omitempty"`
+}
+
+// CalibrationConfig is a saved keyboard calibration, only valid for the
+// MIDI device it was made with.
+type CalibrationConfig struct {
+	Device   string `json:"device"`
+	LeftKey  uint8  `json:"left_key"`
+	RightKey uint8  `json:"right_key"`
+	Reversed bool   `json:"reversed,omitempty"`
+}
+
+// configPath returns the location of the config file, typically
+// ~/.config/huemidi/config.json.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %v", err)
+	}
+	return filepath.Join(dir, "huemidi", "config.json"), nil
+}
+
+// loadConfig reads a profile of the config file. A missing file or
+// profile yields an empty config.
+func loadConfig(profile string) (*Config, error) {
+	file, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &file.Config
+	if profile != defaultProfile {
+		cfg = file.Profiles[profile]
+		if cfg == nil {
+			cfg = &Config{}
+		}
+	}
+	cfg.profile = profile
+	return cfg, nil
+}
+
+// readConfigFile reads every profile of the config file.
+func readConfigFile() (*configFile, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &configFile{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	return file, nil
+}
+
+// saveConfig writes cfg to its profile, leaving the others as they are in
+// the file.
+func saveConfig(cfg *Config) error {
+	file, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if cfg.profile == defaultProfile || cfg.profile == "" {
+		file.Config = *cfg
+	} else {
+		if file.Profiles == nil {
+			file.Profiles = make(map[string]*Config)
+		}
+		file.Profiles[cfg.profile] = cfg
+	}
+	return writeConfigFile(file)
+}
+
+func writeConfigFile(file *configFile) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+
+	// The username grants full control of the bridge, keep it private.
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+
+	return nil
+}
+
+// empty reports whether nothing is saved in the config.
+func (c *Config) empty() bool {
+	return c.IP == "" && c.BridgeID == "" && c.Port == 0 && c.Username == "" && c.ClientKey == "" &&
+		c.Calibration == nil && len(c.Lights) == 0 && c.Mode == ""
+}
+
+// resetConfig forgets a profile, removing the file once neither the
+// default profile nor another one is left in it.
+func resetConfig(profile string) error {
+	file, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if profile == defaultProfile {
+		file.Config = Config{}
+	} else {
+		delete(file.Profiles, profile)
+	}
+	if !file.Config.empty() || len(file.Profiles) > 0 {
+		return writeConfigFile(file)
+	}
+
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove config: %v", err)
+	}
+
+	return nil
+}
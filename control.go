@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// lightStatus is one light in the GET /state response.
+type lightStatus struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	On    bool   `json:"on"`
+	Level *int   `json:"level,omitempty"`
+	State string `json:"state"`
+}
+
+// serveHTTP starts the HTTP control endpoint on addr, letting other devices
+// on the network drive the selected lights next to the MIDI input:
+//
+//	POST /brightness {"value": 0-100}
+//	GET  /state
+//
+// The returned function shuts the server down.
+func (l *midiListener) serveHTTP(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTP server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/brightness", l.handleHTTPBrightness)
+	mux.HandleFunc("/state", l.handleHTTPState)
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error(fmt.Sprintf("❌ HTTP server stopped: %v", err))
+		}
+	}()
+	fmt.Printf("   HTTP control on http://%s (POST /brightness, GET /state)\n", listener.Addr())
+
+	return func() { server.Close() }, nil
+}
+
+func (l *midiListener) handleHTTPBrightness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Value *int `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Value == nil {
+		http.Error(w, `expected {"value": 0-100}`, http.StatusBadRequest)
+		return
+	}
+	if *request.Value < 0 || *request.Value > 100 {
+		http.Error(w, "value must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	l.setBrightness(*request.Value)
+	slog.Info(fmt.Sprintf("🌐 HTTP → %d%% brightness", *request.Value))
+
+	l.writeState(w)
+}
+
+func (l *midiListener) handleHTTPState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	l.writeState(w)
+}
+
+// writeState answers with the level huemidi last set on every light.
+func (l *midiListener) writeState(w http.ResponseWriter) {
+	l.mu.Lock()
+	lights := make([]lightStatus, 0, len(l.lights))
+	for _, light := range l.lights {
+		level := l.levels[light.Key()].current
+		// 0% brightness switches the light off too
+		mode := l.lightMode(&light)
+		on := level != offLevel && (mode != ModeBrightness || level != 0)
+		status := lightStatus{ID: light.ID, Name: light.Name, On: on, State: l.describeLevel(mode, level)}
+		if status.On && level != onLevel {
+			status.Level = &level
+		}
+		lights = append(lights, status)
+	}
+	l.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"mode":   l.mode(),
+		"lights": lights,
+	})
+}
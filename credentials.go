@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/zalando/go-keyring"
+)
+
+// Supported values for Options.CredentialStore.
+const (
+	// StoreAuto uses the OS keyring when there is one, the config file
+	// otherwise.
+	StoreAuto = "auto"
+	// StoreKeyring uses the macOS Keychain, the Secret Service on Linux or
+	// the Windows Credential Manager.
+	StoreKeyring = "keyring"
+	// StoreConfig uses the config file.
+	StoreConfig = "config"
+)
+
+// keyringService and keyringUser name the keyring item holding the
+// credentials of the default profile.
+const (
+	keyringService = "huemidi"
+	keyringUser    = "bridge"
+)
+
+// keyringAccount names the keyring item of a profile, the other profiles
+// getting theirs next to the one of the default profile.
+func keyringAccount(profile string) string {
+	if profile == defaultProfile || profile == "" {
+		return keyringUser
+	}
+	return keyringUser + "/" + profile
+}
+
+// Credentials are what the bridge handed out when pairing.
+type Credentials struct {
+	Username  string `json:"username"`
+	ClientKey string `json:"clientkey,omitempty"`
+}
+
+// CredentialStore keeps the credentials between runs.
+type CredentialStore interface {
+	// Name describes the store for the user.
+	Name() string
+	// Load returns the saved credentials, empty if there are none.
+	Load() (Credentials, error)
+	// Save replaces the saved credentials.
+	Save(creds Credentials) error
+}
+
+// newCredentialStore returns the store named by kind, see the Store*
+// constants.
+func newCredentialStore(kind string, cfg *Config) (CredentialStore, error) {
+	switch kind {
+	case StoreKeyring:
+		store := keyringStore{account: keyringAccount(cfg.profile)}
+		if _, err := store.Load(); err != nil {
+			return nil, fmt.Errorf("keyring unavailable: %v", err)
+		}
+		return store, nil
+	case StoreConfig:
+		return &configStore{cfg: cfg}, nil
+	default:
+		// A keyring that can't even be read, e.g. without a session bus,
+		// isn't going to take the credentials either
+		store := keyringStore{account: keyringAccount(cfg.profile)}
+		if _, err := store.Load(); err == nil {
+			return store, nil
+		}
+		return &configStore{cfg: cfg}, nil
+	}
+}
+
+// keyringStore keeps the credentials in the OS keyring, as a JSON item
+// of the given account.
+type keyringStore struct {
+	account string
+}
+
+func (keyringStore) Name() string {
+	return "the system keyring"
+}
+
+func (s keyringStore) Load() (Credentials, error) {
+	var creds Credentials
+
+	secret, err := keyring.Get(keyringService, s.account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return creds, nil
+	}
+	if err != nil {
+		return creds, err
+	}
+
+	if err := json.Unmarshal([]byte(secret), &creds); err != nil {
+		return creds, fmt.Errorf("failed to parse keyring item: %v", err)
+	}
+	return creds, nil
+}
+
+func (s keyringStore) Save(creds Credentials) error {
+	secret, err := json.Marshal(creds)
+	if err != nil {
+		return fmt.Errorf("failed to encode credentials: %v", err)
+	}
+	if err := keyring.Set(keyringService, s.account, string(secret)); err != nil {
+		return fmt.Errorf("failed to write to keyring: %v", err)
+	}
+	return nil
+}
+
+// clearKeyring removes the credentials of a profile from the keyring, if
+// there are any and a keyring at all.
+func clearKeyring(profile string) {
+	if err := keyring.Delete(keyringService, keyringAccount(profile)); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		slog.Debug("Failed to clear the keyring", "err", err)
+	}
+}
+
+// configStore keeps the credentials in the config file.
+type configStore struct {
+	cfg *Config
+}
+
+func (s *configStore) Name() string {
+	return "the config file"
+}
+
+func (s *configStore) Load() (Credentials, error) {
+	return Credentials{Username: s.cfg.Username, ClientKey: s.cfg.ClientKey}, nil
+}
+
+func (s *configStore) Save(creds Credentials) error {
+	s.cfg.Username = creds.Username
+	s.cfg.ClientKey = creds.ClientKey
+	return saveConfig(s.cfg)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"huemidi/hue"
+)
+
+// Dashboard layout.
+const (
+	dashboardBarWidth = 30
+	dashboardLogLines = 5
+	// dashboardRefresh is how often the dashboard is redrawn without any
+	// update, to age the last MIDI event.
+	dashboardRefresh = time.Second
+)
+
+// dashboardLight is a light as shown on the dashboard.
+type dashboardLight struct {
+	Name string
+	// Fill is how much of the bar is lit, between 0 and 1.
+	Fill  float64
+	Label string
+}
+
+// dashboardUpdate is a snapshot of the listener sent after each MIDI
+// message.
+type dashboardUpdate struct {
+	Mode    string
+	Lights  []dashboardLight
+	Message string
+	At      time.Time
+}
+
+// Dashboard redraws the terminal with the current level of every light and
+// the last MIDI message, instead of scrolling a line per message. Log
+// records are kept to the last few, under the lights.
+type Dashboard struct {
+	w       io.Writer
+	updates chan dashboardUpdate
+	logs    chan string
+	stop    chan struct{}
+	done    chan struct{}
+
+	state dashboardUpdate
+	lines []string
+}
+
+// newDashboard starts drawing to w. Close must be called to give the
+// terminal back.
+func newDashboard(w io.Writer) *Dashboard {
+	d := &Dashboard{
+		w:       w,
+		updates: make(chan dashboardUpdate, 1),
+		logs:    make(chan string, 64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Update replaces the snapshot shown. It never blocks the MIDI callback: an
+// update that wasn't drawn yet is replaced by the newer one.
+func (d *Dashboard) Update(update dashboardUpdate) {
+	select {
+	case d.updates <- update:
+		return
+	default:
+	}
+
+	select {
+	case <-d.updates:
+	default:
+	}
+	select {
+	case d.updates <- update:
+	default:
+	}
+}
+
+// Write takes log output, one record per line, so that logging through the
+// console handler shows up under the lights.
+func (d *Dashboard) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		select {
+		case d.logs <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// Close stops drawing and leaves the last frame on screen.
+func (d *Dashboard) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Dashboard) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+
+	// Hide the cursor while drawing, it would blink over the bars
+	fmt.Fprint(d.w, "\033[?25l")
+	defer fmt.Fprint(d.w, "\033[?25h\n")
+
+	d.render()
+	for {
+		select {
+		case update := <-d.updates:
+			d.state = update
+		case line := <-d.logs:
+			d.lines = append(d.lines, line)
+			if len(d.lines) > dashboardLogLines {
+				d.lines = d.lines[len(d.lines)-dashboardLogLines:]
+			}
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+		d.render()
+	}
+}
+
+// render draws a whole frame at once so it doesn't flicker.
+func (d *Dashboard) render() {
+	var b bytes.Buffer
+	b.WriteString("\033[H\033[2J")
+
+	mode := d.state.Mode
+	if mode == "" {
+		mode = "waiting for MIDI"
+	}
+	fmt.Fprintf(&b, "🎹 HueMIDI · %s · press Ctrl+C to exit\n\n", mode)
+
+	width := 0
+	for _, light := range d.state.Lights {
+		width = max(width, len([]rune(light.Name)))
+	}
+	for _, light := range d.state.Lights {
+		filled := int(min(max(light.Fill, 0), 1)*dashboardBarWidth + 0.5)
+		fmt.Fprintf(&b, "%-*s [%s%s] %s\n", width, light.Name,
+			strings.Repeat("█", filled), strings.Repeat("░", dashboardBarWidth-filled), light.Label)
+	}
+
+	b.WriteString("\n")
+	if d.state.Message != "" {
+		fmt.Fprintf(&b, "Last MIDI: %s (%s ago)\n", d.state.Message, time.Since(d.state.At).Round(time.Second))
+	} else {
+		b.WriteString("Last MIDI: none yet\n")
+	}
+
+	if len(d.lines) > 0 {
+		b.WriteString("\n")
+		for _, line := range d.lines {
+			b.WriteString(line + "\n")
+		}
+	}
+
+	d.w.Write(b.Bytes())
+}
+
+// startDashboard sends the log to a new dashboard on stdout until the
+// returned function is called.
+func startDashboard(level slog.Level) (*Dashboard, func()) {
+	dashboard := newDashboard(os.Stdout)
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newConsoleHandler(dashboard, level)))
+
+	return dashboard, func() {
+		slog.SetDefault(previous)
+		dashboard.Close()
+	}
+}
+
+// snapshot is what the dashboard shows after msg.
+func (l *midiListener) snapshot(msg string) dashboardUpdate {
+	mode := l.mode()
+	update := dashboardUpdate{Mode: mode + " mode", Message: msg, At: time.Now()}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, light := range l.lights {
+		level := l.levels[light.Key()].current
+		lightMode := l.lightMode(&light)
+		update.Lights = append(update.Lights, dashboardLight{
+			Name:  light.Name,
+			Fill:  levelFill(level, lightMode),
+			Label: l.describeLevel(lightMode, level),
+		})
+	}
+	return update
+}
+
+// levelFill is how far a level is across its range, between 0 and 1.
+func levelFill(level int, mode string) float64 {
+	switch {
+	case level == offLevel:
+		return 0
+	case level == onLevel:
+		return 1
+	case mode == ModeColor:
+		return float64(level) / hue.MaxHue
+	case mode == ModeColorTemp:
+		// Warm is the left end, as on the keyboard
+		return float64(hue.MaxColorTemp-level) / (hue.MaxColorTemp - hue.MinColorTemp)
+	default:
+		return float64(level) / 100
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/gomidi/midi/v2"
+
+	"huemidi/hue"
+)
+
+// doctor runs the checks of -doctor, stopping at none of them so that a
+// single run shows everything that is wrong. Checks that need an earlier
+// one to pass are skipped instead of failing for the same reason.
+type doctor struct {
+	failed int
+}
+
+func (d *doctor) pass(check, detail string) {
+	fmt.Printf("✅ %s: %s\n", check, detail)
+}
+
+func (d *doctor) fail(check string, err error, hint string) {
+	d.failed++
+	fmt.Printf("❌ %s: %v\n", check, err)
+	fmt.Printf("   💡 %s\n", hint)
+}
+
+func (d *doctor) skip(check, reason string) {
+	fmt.Printf("⏭️  %s: skipped, %s\n", check, reason)
+}
+
+// runDoctor checks in turn everything huemidi needs, from the discovery
+// endpoint to the MIDI device, without pairing or calibrating, and fails if
+// any check does.
+func runDoctor(cfg *Config, opts *Options) error {
+	fmt.Println("🩺 Checking your setup...")
+	d := &doctor{}
+
+	// Discovery only matters when the bridge isn't known already
+	bridges, err := hue.DiscoverCloud(opts.DiscoveryURL)
+	switch {
+	case err != nil && (opts.BridgeIP != "" || cfg.IP != ""):
+		d.pass("Discovery", fmt.Sprintf("unavailable (%v), but not needed with a known bridge", err))
+	case err != nil:
+		d.fail("Discovery", err, "check the internet connection, or give the bridge with -bridge-ip (mDNS is tried too when running normally)")
+	default:
+		d.pass("Discovery", fmt.Sprintf("%s answered with %d bridges", opts.DiscoveryURL, len(bridges)))
+	}
+
+	// The same bridge as a normal run: the flag, the saved one, or the
+	// first discovered
+	var bridge *hue.Bridge
+	switch {
+	case opts.BridgeIP != "":
+		bridge = &hue.Bridge{IP: opts.BridgeIP}
+	case cfg.IP != "":
+		bridge = &hue.Bridge{IP: cfg.IP, ID: cfg.BridgeID, Port: cfg.Port}
+	case len(bridges) > 0:
+		bridge = &bridges[0]
+	}
+	if bridge == nil {
+		d.skip("Bridge", "no bridge address is known")
+	} else if err := hue.CheckBridge(bridge.Addr()); err != nil {
+		d.fail("Bridge", err, "check that the bridge is powered and on this network, and that -bridge-ip or the saved IP (see -reset-config) is right")
+		bridge = nil
+	} else {
+		name := hue.BridgeName(bridge.Addr())
+		if name == "" {
+			name = "the bridge"
+		}
+		d.pass("Bridge", fmt.Sprintf("%s answers at %s", name, bridge.Addr()))
+	}
+
+	// The username a normal run would try first, see
+	// authenticateWithBridge
+	username, source := opts.Username, "-username"
+	if store, err := newCredentialStore(opts.CredentialStore, cfg); username == "" && err == nil {
+		if _, ok := store.(keyringStore); ok {
+			if creds, err := store.Load(); err == nil && creds.Username != "" {
+				username, source = creds.Username, "the keyring"
+			}
+		}
+	}
+	if username == "" && os.Getenv("HUE_USERNAME") != "" {
+		username, source = os.Getenv("HUE_USERNAME"), "HUE_USERNAME"
+	}
+	if username == "" && cfg.Username != "" {
+		username, source = cfg.Username, "the config file"
+	}
+	switch {
+	case bridge == nil:
+		d.skip("Username", "the bridge isn't reachable")
+	case username == "":
+		d.fail("Username", fmt.Errorf("not paired yet"), "run huemidi without -doctor and press the link button on the bridge when asked")
+	default:
+		if err := hue.CheckUsername(bridge, username); err != nil {
+			d.fail("Username", fmt.Errorf("the username from %s was rejected: %v", source, err), "run with -reset-config to pair again, or fix -username / HUE_USERNAME")
+		} else {
+			bridge.Username = username
+			d.pass("Username", "accepted, from "+source)
+		}
+	}
+
+	if bridge != nil {
+		if bridge.ID == "" {
+			bridge.ID = hue.BridgeID(bridge.Addr())
+		}
+		bridge.InsecureTLS = opts.InsecureTLS
+	}
+	if bridge == nil || bridge.Username == "" {
+		d.skip("Lights", "no accepted username")
+	} else if err := hue.ChooseAPI(bridge, opts.API); err != nil {
+		d.fail("Lights", err, "try -api v1")
+	} else if lights, err := hue.NewClient(bridge).Lights(); err != nil {
+		d.fail("Lights", err, "add lights in the Hue app, or try -api v1 if the v2 API fails (-insecure-tls if it rejects the certificate)")
+	} else {
+		unreachable := 0
+		for _, light := range lights {
+			if !light.Reachable {
+				unreachable++
+			}
+		}
+		d.pass("Lights", fmt.Sprintf("%d found, %d unreachable", len(lights), unreachable))
+	}
+
+	defer midi.CloseDriver()
+	if ins := midi.GetInPorts(); len(ins) == 0 {
+		d.fail("MIDI", fmt.Errorf("no MIDI input devices found"), "plug in the keyboard and check it shows up in your system's MIDI settings (on Linux, that the ALSA sequencer is loaded)")
+	} else {
+		names := make([]string, len(ins))
+		for i, in := range ins {
+			names[i] = in.String()
+		}
+		d.pass("MIDI", strings.Join(names, ", "))
+	}
+
+	if d.failed > 0 {
+		return fmt.Errorf("%d checks failed", d.failed)
+	}
+	fmt.Println("🎉 Everything looks good")
+	return nil
+}
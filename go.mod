@@ -4,13 +4,21 @@ go 1.21
 
 require (
 	github.com/manifoldco/promptui v0.9.0
+	github.com/pion/dtls/v2 v2.2.12
 	github.com/tidwall/gjson v1.17.0
+	github.com/zalando/go-keyring v0.2.8
 	gitlab.com/gomidi/midi/v2 v2.0.30
+	golang.org/x/net v0.20.0
 )
 
 require (
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
+	github.com/danieljoos/wincred v1.2.3 // indirect
+	github.com/godbus/dbus/v5 v5.2.2 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport/v2 v2.2.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	golang.org/x/sys v0.0.0-20181122145206-62eef0e2fa9b // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
 )
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/drivers"
+)
+
+// midiPollInterval is how often the MIDI ports are listed to notice the
+// device being unplugged or plugged back in.
+const midiPollInterval = 2 * time.Second
+
+// midiConnection listens to a MIDI device and survives it being unplugged:
+// the driver doesn't report a vanished port, so the ports are polled and
+// the listener set up again once a port with the same name comes back.
+type midiConnection struct {
+	name   string
+	handle func(msg midi.Message, timestampms int32)
+
+	mu     sync.Mutex
+	stop   func()
+	closed bool
+}
+
+func listenMIDI(in drivers.In, handle func(msg midi.Message, timestampms int32)) (*midiConnection, error) {
+	handle = recoverMIDI(handle)
+	stop, err := midi.ListenTo(in, handle, midi.UseSysEx())
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen to MIDI device: %v", err)
+	}
+	return &midiConnection{name: in.String(), handle: handle, stop: stop}, nil
+}
+
+// recoverMIDI keeps a panic while handling one message from taking the
+// listener down, the message is logged and the next one handled as usual.
+func recoverMIDI(handle func(msg midi.Message, timestampms int32)) func(msg midi.Message, timestampms int32) {
+	return func(msg midi.Message, timestampms int32) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error(fmt.Sprintf("❌ Panic while handling MIDI message %s: %v", msg, r))
+			}
+		}()
+		handle(msg, timestampms)
+	}
+}
+
+// watch reconnects to the device until ctx is done.
+func (c *midiConnection) watch(ctx context.Context) {
+	ticker := time.NewTicker(midiPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		port := findMIDIPort(c.name)
+
+		c.mu.Lock()
+		switch {
+		case c.closed:
+		case c.stop != nil && port == nil:
+			slog.Warn(fmt.Sprintf("🔌 MIDI device %q disconnected, waiting for it to come back...", c.name))
+			c.stop()
+			c.stop = nil
+		case c.stop == nil && port != nil:
+			slog.Info(fmt.Sprintf("🔌 MIDI device %q is back, reconnecting", c.name))
+			stop, err := midi.ListenTo(port, c.handle, midi.UseSysEx())
+			if err != nil {
+				slog.Warn(fmt.Sprintf("⚠️  Failed to reconnect, retrying: %v", err))
+			} else {
+				c.stop = stop
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Close stops listening.
+func (c *midiConnection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+}
+
+// findMIDIPort returns the input port with exactly the given name, or nil.
+func findMIDIPort(name string) drivers.In {
+	for _, in := range midi.GetInPorts() {
+		if in.String() == name {
+			return in
+		}
+	}
+	return nil
+}
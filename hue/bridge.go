@@ -0,0 +1,289 @@
+package hue
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Bridge is a Hue bridge found on the network, and once paired the user
+// talking to it.
+type Bridge struct {
+	IP string
+	// ID is the bridge's own ID, e.g. "001788fffe123456", which stays
+	// the same when its IP changes.
+	ID string
+	// Port is where discovery said the bridge answers, 0 for the usual
+	// 80 and 443.
+	Port     int
+	Username string
+	// ClientKey is only handed out by bridges that support API v2.
+	ClientKey string
+	// APIVersion is the version reported by the bridge, e.g. "1.56.0".
+	APIVersion string
+	// UseV2 selects the CLIP v2 API over the legacy v1 endpoints.
+	UseV2 bool
+	// InsecureTLS accepts any certificate on the v2 API instead of only
+	// one issued to ID.
+	InsecureTLS bool
+}
+
+// Addr is where the bridge answers, v1 over HTTP and v2 over HTTPS: its IP
+// for a real bridge, which uses the standard ports, or the IP and port
+// reported by discovery for an emulator or proxy serving both there.
+func (b *Bridge) Addr() string {
+	if b.Port == 0 || b.Port == 443 {
+		return b.IP
+	}
+	return net.JoinHostPort(b.IP, strconv.Itoa(b.Port))
+}
+
+// probeClient is used for quick checks against a saved bridge so that a
+// stale IP fails fast instead of hanging on the TCP connect.
+var probeClient = &http.Client{Timeout: 3 * time.Second}
+
+// CheckBridge verifies that a Hue bridge answers at the given host.
+func CheckBridge(host string) error {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/api/0/config", host))
+	if err != nil {
+		return fmt.Errorf("bridge at %s is not reachable: %v", host, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read config from %s: %v", host, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with HTTP status %d, is it a Hue bridge?", host, resp.StatusCode)
+	}
+	if !gjson.GetBytes(body, "bridgeid").Exists() {
+		return fmt.Errorf("%s does not look like a Hue bridge", host)
+	}
+
+	return nil
+}
+
+// BridgeReachable reports whether a Hue bridge answers at the given host.
+func BridgeReachable(host string) bool {
+	return CheckBridge(host) == nil
+}
+
+// UsernameValid reports whether the bridge accepts the given username.
+func UsernameValid(bridge *Bridge, username string) bool {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/api/%s/lights", bridge.Addr(), username))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+
+	return gjson.ValidBytes(body) && !gjson.GetBytes(body, "0.error").Exists()
+}
+
+// usernameFormat matches the usernames bridges hand out when pairing.
+var usernameFormat = regexp.MustCompile(`^[A-Za-z0-9-]{40}$`)
+
+// ValidUsernameFormat reports whether username looks like one handed out
+// by a bridge, without asking it.
+func ValidUsernameFormat(username string) bool {
+	return usernameFormat.MatchString(username)
+}
+
+// CheckUsername verifies that the bridge accepts username, failing with a
+// BridgeError of type ErrTypeUnauthorized if it doesn't.
+func CheckUsername(bridge *Bridge, username string) error {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/api/%s/config", bridge.Addr(), username))
+	if err != nil {
+		return fmt.Errorf("bridge at %s is not reachable: %v", bridge.Addr(), err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read config from %s: %v", bridge.Addr(), err)
+	}
+
+	if e := gjson.GetBytes(body, "0.error"); e.Exists() {
+		return &BridgeError{
+			Type:        int(e.Get("type").Int()),
+			Address:     e.Get("address").String(),
+			Description: e.Get("description").String(),
+		}
+	}
+	// Unknown users get the public part of the config instead of an error
+	if !gjson.GetBytes(body, "ipaddress").Exists() {
+		return &BridgeError{Type: ErrTypeUnauthorized, Address: "/config", Description: "unauthorized user"}
+	}
+	return nil
+}
+
+// PublicConfig is the part of the bridge config shared without a
+// username. Older bridges leave out some fields, which are empty then.
+type PublicConfig struct {
+	Name string
+	// ModelID is e.g. "BSB002", see Model.
+	ModelID    string
+	APIVersion string
+	SWVersion  string
+	// BridgeID is in the lowercase form discovery uses.
+	BridgeID string
+}
+
+// bridgeModels are the names of the bridge model IDs.
+var bridgeModels = map[string]string{
+	"BSB001": "Hue Bridge v1",
+	"BSB002": "Hue Bridge v2",
+	"BSB003": "Hue Bridge Pro",
+}
+
+// Model returns the name of the bridge model, the model ID for unknown
+// ones, or an empty string if the bridge didn't say.
+func (c *PublicConfig) Model() string {
+	if name, ok := bridgeModels[c.ModelID]; ok {
+		return name
+	}
+	return c.ModelID
+}
+
+// FetchPublicConfig returns the config the bridge at host shares without
+// a username.
+func FetchPublicConfig(host string) (*PublicConfig, error) {
+	body, err := publicConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first firmwares answer with an unauthorized error instead
+	result := gjson.ParseBytes(body)
+	if !result.IsObject() {
+		return nil, fmt.Errorf("%s doesn't share its config without a username", host)
+	}
+	return &PublicConfig{
+		Name:       result.Get("name").String(),
+		ModelID:    result.Get("modelid").String(),
+		APIVersion: result.Get("apiversion").String(),
+		SWVersion:  result.Get("swversion").String(),
+		BridgeID:   strings.ToLower(result.Get("bridgeid").String()),
+	}, nil
+}
+
+// PublicConfigField returns a field of the config the bridge shares
+// without a username, or an empty string if it can't be fetched.
+func PublicConfigField(host, field string) string {
+	body, err := publicConfig(host)
+	if err != nil {
+		return ""
+	}
+
+	return gjson.GetBytes(body, field).String()
+}
+
+func publicConfig(host string) ([]byte, error) {
+	resp, err := probeClient.Get(fmt.Sprintf("http://%s/api/0/config", host))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get config from %s: %v", host, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from %s: %v", host, err)
+	}
+	return body, nil
+}
+
+// BridgeName returns the name the user gave the bridge, or an empty string
+// if it can't be fetched.
+func BridgeName(host string) string {
+	return PublicConfigField(host, "name")
+}
+
+// BridgeID returns the ID of the bridge in the lowercase form discovery
+// uses, or an empty string if it can't be fetched.
+func BridgeID(host string) string {
+	return strings.ToLower(PublicConfigField(host, "bridgeid"))
+}
+
+// DefaultDiscoveryURL is the official Hue discovery endpoint.
+const DefaultDiscoveryURL = "https://discovery.meethue.com/"
+
+// DiscoverCloud asks the discovery endpoint for bridges on our network.
+func DiscoverCloud(endpoint string) ([]Bridge, error) {
+	resp, err := httpClient.Get(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover bridge: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read discovery response: %v", err)
+	}
+
+	// Captive portals and proxies answer with an HTML page or nothing at
+	// all, which would otherwise just look like there is no bridge
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery endpoint returned HTTP %d, check your network or use --bridge-ip", resp.StatusCode)
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("discovery endpoint returned non-JSON response (HTTP %d, %s), check your network or use --bridge-ip", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Parse JSON response
+	var bridges []Bridge
+	gjson.ParseBytes(body).ForEach(func(_, value gjson.Result) bool {
+		if ip := value.Get("internalipaddress").String(); ip != "" {
+			bridges = append(bridges, Bridge{
+				IP:   ip,
+				ID:   strings.ToLower(value.Get("id").String()),
+				Port: int(value.Get("port").Int()),
+			})
+		}
+		return true
+	})
+
+	return bridges, nil
+}
+
+// CreateUser asks the bridge for a new username, along with a client key
+// on v2 bridges. It fails with a BridgeError of type
+// ErrTypeLinkButtonNotPressed until the link button is pressed, callers
+// keep trying meanwhile.
+func CreateUser(bridge *Bridge, deviceType string) (username, clientKey string, err error) {
+	requestBody := fmt.Sprintf(`{"devicetype":%q}`, deviceType)
+	if bridge.UseV2 {
+		requestBody = fmt.Sprintf(`{"devicetype":%q,"generateclientkey":true}`, deviceType)
+	}
+
+	body, err := doRequest("POST", fmt.Sprintf("http://%s/api", bridge.Addr()), requestBody)
+	if err != nil {
+		return "", "", err
+	}
+
+	if e := gjson.GetBytes(body, "0.error"); e.Exists() {
+		return "", "", &BridgeError{
+			Type:        int(e.Get("type").Int()),
+			Address:     e.Get("address").String(),
+			Description: e.Get("description").String(),
+		}
+	}
+
+	result := gjson.GetBytes(body, "0.success")
+	if !result.Get("username").Exists() {
+		return "", "", fmt.Errorf("unexpected response: %s", body)
+	}
+	return result.Get("username").String(), result.Get("clientkey").String(), nil
+}
@@ -0,0 +1,385 @@
+// Package hue talks to Philips Hue bridges: finding them on the network,
+// pairing, and driving their lights, groups and scenes over the v1 or v2
+// API.
+package hue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Client sends commands to one bridge on behalf of a paired user, built
+// once authentication is done.
+type Client struct {
+	// Host and TLSHost are where the v1 and v2 APIs answer, an IP that
+	// may include a port.
+	Host     string
+	TLSHost  string
+	Username string
+	// UseV2 selects the CLIP v2 API over the legacy v1 endpoints.
+	UseV2 bool
+
+	// HTTP carries the v1 requests and HTTPS the v2 ones.
+	HTTP  *http.Client
+	HTTPS *http.Client
+
+	// DryRun logs state changes instead of sending them. Reads still
+	// reach the bridge.
+	DryRun bool
+
+	// Metrics, when set, is told about every request to the bridge.
+	Metrics Metrics
+
+	// ctx, when set by WithContext, cancels the requests.
+	ctx context.Context
+
+	// cache holds the last list of lights fetched, see Lights. It is
+	// shared by the copies made by WithContext.
+	cache *lightsCache
+}
+
+type lightsCache struct {
+	mu     sync.Mutex
+	lights []Light
+}
+
+// Metrics receives measurements from a Client, e.g. to export them.
+type Metrics interface {
+	// Request is called after each request, with the error if it failed.
+	Request(err error)
+	// SetBrightness is called with how long each brightness change took.
+	SetBrightness(d time.Duration)
+}
+
+// NewClient returns a client for a paired bridge.
+func NewClient(bridge *Bridge) *Client {
+	return &Client{
+		Host:     bridge.Addr(),
+		TLSHost:  bridge.Addr(),
+		Username: bridge.Username,
+		UseV2:    bridge.UseV2,
+		HTTP:     httpClient,
+		HTTPS:    bridgeTLSClient(bridge),
+		cache:    &lightsCache{},
+	}
+}
+
+// WithContext returns a copy of the client whose requests are canceled
+// once ctx is done, e.g. when a newer update makes them pointless.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	copied := *c
+	copied.ctx = ctx
+	return &copied
+}
+
+// context is what requests are bound to.
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// v1 error types worth telling apart, see BridgeError. The v2 API reports
+// an unknown key as ErrTypeUnauthorized too.
+const (
+	ErrTypeUnauthorized = 1
+	ErrTypeUnavailable  = 3
+	// ErrTypeLinkButtonNotPressed is returned by CreateUser until the link
+	// button is pressed.
+	ErrTypeLinkButtonNotPressed = 101
+	// ErrTypeInternal is what an overloaded v1 bridge answers when it
+	// gets more commands than it can handle.
+	ErrTypeInternal = 901
+)
+
+// ErrRateLimited is returned when the bridge answers HTTP 429, asking us
+// to send fewer requests.
+var ErrRateLimited = errors.New("bridge is rate limiting requests")
+
+// IsRateLimited reports whether err means the bridge is getting requests
+// faster than it can handle, either as HTTP 429 or as a v1 internal error.
+func IsRateLimited(err error) bool {
+	return errors.Is(err, ErrRateLimited) || IsBridgeError(err, ErrTypeInternal)
+}
+
+// BridgeError is an error the v1 API reported in its response, or an
+// unauthorized key on the v2 API.
+type BridgeError struct {
+	Type        int
+	Address     string
+	Description string
+}
+
+func (e *BridgeError) Error() string {
+	return fmt.Sprintf("bridge error %d: %s", e.Type, e.Description)
+}
+
+// IsBridgeError reports whether err is a BridgeError of the given type.
+func IsBridgeError(err error, errType int) bool {
+	var bridgeErr *BridgeError
+	return errors.As(err, &bridgeErr) && bridgeErr.Type == errType
+}
+
+// v1Request sends a request to a v1 API path such as "/lights" and returns
+// the body. Errors in the response array come back as a *BridgeError.
+func (c *Client) v1Request(method, path, body string) (data []byte, err error) {
+	defer func() { c.observeRequest(err) }()
+
+	url := fmt.Sprintf("http://%s/api/%s%s", c.Host, c.Username, path)
+	data, err = doRequestWith(c.context(), c.HTTP, method, url, body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Successful reads return an object, writes and failures an array of
+	// results that may mix successes and errors.
+	if result := gjson.ParseBytes(data); result.IsArray() {
+		if e := result.Get("#.error").Array(); len(e) > 0 {
+			return nil, &BridgeError{
+				Type:        int(e[0].Get("type").Int()),
+				Address:     e[0].Get("address").String(),
+				Description: e[0].Get("description").String(),
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// observeRequest reports a request to c.Metrics.
+func (c *Client) observeRequest(err error) {
+	if c.Metrics != nil {
+		c.Metrics.Request(err)
+	}
+}
+
+// SetState sends a raw state body to a light, in the format of the API
+// version in use.
+func (c *Client) SetState(light *Light, body string) error {
+	if c.DryRun {
+		url := fmt.Sprintf("http://%s/api/%s%s", c.Host, c.Username, light.statePath())
+		if c.UseV2 {
+			url = fmt.Sprintf("https://%s/clip/v2%s", c.TLSHost, light.v2Path())
+		}
+		slog.Info(fmt.Sprintf("🧪 PUT %s %s", url, body))
+		return nil
+	}
+
+	var err error
+	if c.UseV2 {
+		_, err = c.v2Request("PUT", light.v2Path(), body)
+	} else {
+		_, err = c.v1Request("PUT", light.statePath(), body)
+	}
+	return err
+}
+
+// Group is a room, zone or other group of lights. On the v2 API the ID is
+// the room or zone's grouped_light, the resource its lights are driven
+// through.
+type Group struct {
+	ID       string
+	Name     string
+	Type     string
+	LightIDs []string
+}
+
+// Groups returns the groups defined on the bridge, the rooms and zones on
+// the v2 API.
+func (c *Client) Groups() ([]Group, error) {
+	if c.UseV2 {
+		return c.groupsV2()
+	}
+
+	body, err := c.v1Request("GET", "/groups", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups: %v", err)
+	}
+
+	var groups []Group
+	gjson.ParseBytes(body).ForEach(func(key, value gjson.Result) bool {
+		group := Group{
+			ID:   key.String(),
+			Name: value.Get("name").String(),
+			Type: value.Get("type").String(),
+		}
+		for _, id := range value.Get("lights").Array() {
+			group.LightIDs = append(group.LightIDs, id.String())
+		}
+		groups = append(groups, group)
+		return true
+	})
+
+	return groups, nil
+}
+
+// Lights returns the lights known to the bridge, only asking it the first
+// time. RefreshLights picks up lights added since.
+func (c *Client) Lights() ([]Light, error) {
+	if c.cache == nil {
+		return c.fetchLights()
+	}
+
+	c.cache.mu.Lock()
+	cached := c.cache.lights
+	c.cache.mu.Unlock()
+	if cached != nil {
+		return slices.Clone(cached), nil
+	}
+	return c.RefreshLights()
+}
+
+// RefreshLights asks the bridge for its lights again and caches them.
+func (c *Client) RefreshLights() ([]Light, error) {
+	lights, err := c.fetchLights()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cache != nil {
+		c.cache.mu.Lock()
+		c.cache.lights = lights
+		c.cache.mu.Unlock()
+	}
+	return slices.Clone(lights), nil
+}
+
+func (c *Client) fetchLights() ([]Light, error) {
+	var lights []Light
+	if c.UseV2 {
+		var err error
+		lights, err = c.lightsV2()
+		if err != nil {
+			return nil, err
+		}
+		if len(lights) == 0 {
+			return nil, fmt.Errorf("no lights found")
+		}
+		return lights, nil
+	}
+
+	body, err := c.v1Request("GET", "/lights", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lights: %v", err)
+	}
+
+	result := gjson.ParseBytes(body)
+	if !result.IsObject() {
+		return nil, fmt.Errorf("failed to get lights: expected an object of lights")
+	}
+
+	skipped := 0
+	result.ForEach(func(key, value gjson.Result) bool {
+		if !looksLikeLight(value) {
+			slog.Debug("Skipping an entry of /lights that isn't a light", "id", key.String(), "name", value.Get("name").String())
+			skipped++
+			return true
+		}
+
+		lights = append(lights, Light{
+			ID:   key.String(),
+			Name: value.Get("name").String(),
+			Type: value.Get("type").String(),
+			// Lights only report the state fields they support
+			SupportsColor:     value.Get("state.hue").Exists(),
+			SupportsColorTemp: value.Get("state.ct").Exists(),
+			SupportsDimming:   value.Get("state.bri").Exists(),
+			// Lights without the field are assumed to be reachable
+			Reachable: !value.Get("state.reachable").Exists() || value.Get("state.reachable").Bool(),
+		})
+		return true
+	})
+
+	if len(lights) == 0 {
+		if skipped > 0 {
+			return nil, fmt.Errorf("no lights found, none of the %d entries the bridge returned looks like a light", skipped)
+		}
+		return nil, fmt.Errorf("no lights found")
+	}
+
+	return lights, nil
+}
+
+// looksLikeLight reports whether an entry of the v1 /lights object is a
+// light: named, with a state that can be switched on and off. Groups and
+// sensors, which some firmwares and proxies mix in, have a different
+// state.
+func looksLikeLight(value gjson.Result) bool {
+	on := value.Get("state.on")
+	return value.Get("name").String() != "" && (on.Type == gjson.True || on.Type == gjson.False)
+}
+
+// MaxTransition is the longest transition the v1 API accepts, as
+// transitiontime is a 16-bit count of deciseconds.
+const MaxTransition = 65535 * 100 * time.Millisecond
+
+// StateOptions tweaks how a light state change is applied.
+type StateOptions struct {
+	// Transition is how long the light takes to reach the new state, in
+	// steps of 100ms. 0 leaves the bridge's default.
+	Transition time.Duration
+}
+
+// transitionTime returns the v1 transitiontime in deciseconds.
+func (o StateOptions) transitionTime() int {
+	return int(o.Transition.Round(100*time.Millisecond) / (100 * time.Millisecond))
+}
+
+// SetBrightness sets a brightness percentage, 0 switching the light off.
+func (c *Client) SetBrightness(light *Light, brightness int, stateOpts StateOptions) error {
+	return c.SetLightState(light, BrightnessUpdate(brightness, stateOpts))
+}
+
+// SetOn switches a light on or off, leaving the rest of its state alone.
+func (c *Client) SetOn(light *Light, on bool) error {
+	return c.SetLightState(light, LightUpdate{On: &on})
+}
+
+// SetColor sets the hue and saturation (0-254). Callers use MaxSat
+// unless something modulates it, so the color is actually visible.
+func (c *Client) SetColor(light *Light, hue, sat int) error {
+	return c.SetLightState(light, ColorUpdate(hue, sat))
+}
+
+// ErrSaturationUnsupported is returned when saturation can't be changed
+// without also knowing the hue.
+var ErrSaturationUnsupported = errors.New("changing saturation alone is not supported by the v2 API")
+
+// SetSaturation changes only the saturation (0-254) of a color light,
+// keeping its current hue. The v2 API has no saturation of its own, so it
+// returns ErrSaturationUnsupported there.
+func (c *Client) SetSaturation(light *Light, sat int) error {
+	return c.SetLightState(light, SaturationUpdate(sat))
+}
+
+// SetColorTemp sets a white color temperature, in mireds.
+func (c *Client) SetColorTemp(light *Light, mireds int) error {
+	return c.SetLightState(light, ColorTempUpdate(mireds))
+}
+
+// Supported values for the v1 alert effect.
+const (
+	// AlertSelect flashes the light once.
+	AlertSelect = "select"
+	// AlertLSelect keeps flashing the light for 15 seconds.
+	AlertLSelect = "lselect"
+)
+
+// Alert makes a light flash. v2 only has a single "breathe" effect, used
+// for both alerts.
+func (c *Client) Alert(light *Light, alert string) error {
+	if c.UseV2 {
+		return c.SetState(light, `{"alert":{"action":"breathe"}}`)
+	}
+
+	return c.SetState(light, fmt.Sprintf(`{"alert":"%s"}`, alert))
+}
@@ -0,0 +1,71 @@
+package hue
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// request is what a test bridge received.
+type request struct {
+	method string
+	path   string
+	body   string
+}
+
+// newTestBridge serves the v1 API, answering every request with success,
+// and records what it gets.
+func newTestBridge(t *testing.T) (*Client, <-chan request) {
+	t.Helper()
+
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{method: r.Method, path: r.URL.Path, body: string(body)}
+		io.WriteString(w, `[{"success":{}}]`)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	client := NewClient(&Bridge{IP: host, Port: portNumber, Username: "testuser"})
+	return client, requests
+}
+
+func TestSetBrightnessV1(t *testing.T) {
+	tests := []struct {
+		name       string
+		brightness int
+		want       string
+	}{
+		{"off", 0, `{"on":false}`},
+		{"lowest", 1, `{"on":true,"bri":2}`},
+		{"half", 50, `{"on":true,"bri":127}`},
+		{"full", 100, `{"on":true,"bri":254}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, requests := newTestBridge(t)
+			light := &Light{ID: "3", Name: "Desk", SupportsDimming: true}
+
+			if err := client.SetBrightness(light, tt.brightness, StateOptions{}); err != nil {
+				t.Fatalf("SetBrightness(%d): %v", tt.brightness, err)
+			}
+
+			got := <-requests
+			if got.method != "PUT" || got.path != "/api/testuser/lights/3/state" {
+				t.Errorf("SetBrightness(%d) sent %s %s, want PUT /api/testuser/lights/3/state", tt.brightness, got.method, got.path)
+			}
+			if got.body != tt.want {
+				t.Errorf("SetBrightness(%d) sent %s, want %s", tt.brightness, got.body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package hue
+
+import "math"
+
+// MaxHue is the top of the Hue color wheel.
+const MaxHue = 65535
+
+// MaxSat is full saturation.
+const MaxSat = 254
+
+// Color temperature range of Hue white ambiance lights, in mireds. Fewer
+// mireds is cooler.
+const (
+	MinColorTemp = 153
+	MaxColorTemp = 500
+)
+
+// hueSatToXY converts a v1 hue (0-65535) and saturation (0-254) to CIE xy
+// coordinates using the Wide RGB D65 conversion recommended by Philips.
+func hueSatToXY(hue, sat int) (float64, float64) {
+	r, g, b := hsvToRGB(float64(hue)/MaxHue*360, float64(sat)/MaxSat, 1)
+
+	gamma := func(c float64) float64 {
+		if c > 0.04045 {
+			return math.Pow((c+0.055)/1.055, 2.4)
+		}
+		return c / 12.92
+	}
+	r, g, b = gamma(r), gamma(g), gamma(b)
+
+	X := r*0.649926 + g*0.103455 + b*0.197109
+	Y := r*0.234327 + g*0.743075 + b*0.022598
+	Z := g*0.053077 + b*1.035763
+
+	sum := X + Y + Z
+	if sum == 0 {
+		return 0, 0
+	}
+	return X / sum, Y / sum
+}
+
+func hsvToRGB(h, s, v float64) (float64, float64, float64) {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return r + m, g + m, b + m
+}
+
+// colorTempToXY converts a color temperature in mireds to CIE xy
+// coordinates on the Planckian locus, with the cubic spline approximation
+// of Kim et al., valid from 1667K to 25000K.
+func colorTempToXY(mireds int) (float64, float64) {
+	t := min(max(1000000/float64(max(mireds, 1)), 1667), 25000)
+
+	var x float64
+	if t <= 4000 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+
+	var y float64
+	switch {
+	case t <= 2222:
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	case t <= 4000:
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	default:
+		y = 3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+	return x, y
+}
@@ -0,0 +1,163 @@
+package hue
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// eventRetryMin and eventRetryMax bound the delay between reconnection
+	// attempts when the event stream drops.
+	eventRetryMin = time.Second
+	eventRetryMax = 30 * time.Second
+)
+
+// CachedLightState is the last known state of a light as reported by the
+// bridge's event stream.
+type CachedLightState struct {
+	On bool
+	// Brightness is in percent and only meaningful if HasBrightness is set.
+	Brightness    float64
+	HasBrightness bool
+}
+
+// LightCache keeps the latest state of the watched lights, including
+// changes made from other apps.
+type LightCache struct {
+	mu     sync.Mutex
+	states map[string]CachedLightState
+}
+
+// NewLightCache returns an empty cache, filled by WatchEvents.
+func NewLightCache() *LightCache {
+	return &LightCache{states: make(map[string]CachedLightState)}
+}
+
+// Get returns the cached state of a light, if any event was seen for it.
+func (c *LightCache) Get(id string) (CachedLightState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.states[id]
+	return state, ok
+}
+
+// update merges the fields present in a v2 light resource into the cache
+// and returns the resulting state.
+func (c *LightCache) update(id string, resource gjson.Result) CachedLightState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.states[id]
+	if on := resource.Get("on.on"); on.Exists() {
+		state.On = on.Bool()
+	}
+	if brightness := resource.Get("dimming.brightness"); brightness.Exists() {
+		state.Brightness = brightness.Float()
+		state.HasBrightness = true
+	}
+	c.states[id] = state
+
+	return state
+}
+
+// WatchEvents consumes the v2 event stream until ctx is done, caching the
+// state of the given lights and calling onChange for each update to one of
+// them. The stream is reopened with backoff whenever it drops.
+func WatchEvents(ctx context.Context, client *Client, lights []Light, cache *LightCache, onChange func(light *Light, state CachedLightState)) {
+	byID := make(map[string]*Light)
+	for i := range lights {
+		byID[lights[i].ID] = &lights[i]
+	}
+
+	delay := eventRetryMin
+	for {
+		start := time.Now()
+		err := streamEvents(ctx, client, func(resource gjson.Result) {
+			light, ok := byID[resource.Get("id").String()]
+			if !ok {
+				return
+			}
+			onChange(light, cache.update(light.ID, resource))
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that stayed up for a while resets the backoff
+		if time.Since(start) > eventRetryMax {
+			delay = eventRetryMin
+		}
+		slog.Warn(fmt.Sprintf("⚠️  Event stream disconnected (%v), reconnecting in %s", err, delay))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > eventRetryMax {
+			delay = eventRetryMax
+		}
+	}
+}
+
+// streamEvents reads one connection of the event stream, calling handle for
+// every light resource in the updates it receives.
+func streamEvents(ctx context.Context, client *Client, handle func(resource gjson.Result)) error {
+	url := fmt.Sprintf("https://%s/eventstream/clip/v2", client.TLSHost)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Hue-Application-Key", client.Username)
+	req.Header.Set("Accept", "text/event-stream")
+
+	// No timeout, the event stream stays open for the whole session
+	eventClient := &http.Client{Transport: client.HTTPS.Transport}
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		// Each message is an array of events, each carrying the changed
+		// resources in its "data" array.
+		gjson.Parse(data).ForEach(func(_, event gjson.Result) bool {
+			if event.Get("type").String() != "update" {
+				return true
+			}
+			event.Get("data").ForEach(func(_, resource gjson.Result) bool {
+				if resource.Get("type").String() == "light" {
+					handle(resource)
+				}
+				return true
+			})
+			return true
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by bridge")
+}
@@ -0,0 +1,117 @@
+package hue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// httpClient is shared by every call to the bridge and the discovery
+// endpoint so a flaky network can't hang the program.
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+const (
+	// maxAttempts is how many times a request is tried before giving up.
+	maxAttempts = 3
+	// retryBackoff is the delay before the first retry, doubled each time.
+	retryBackoff = 200 * time.Millisecond
+)
+
+// doRequest sends a request and returns the response body, retrying with
+// backoff when the failure looks transient (timeouts, refused or reset
+// connections). An empty body sends no payload.
+func doRequest(method, url, body string) ([]byte, error) {
+	return doRequestWith(context.Background(), httpClient, method, url, body, nil)
+}
+
+// doRequestWith is doRequest using the given client and extra headers. It
+// gives up, retries included, as soon as ctx is done.
+func doRequestWith(ctx context.Context, client *http.Client, method, url, body string, header http.Header) ([]byte, error) {
+	data, _, err := doRequestStatus(ctx, client, method, url, body, header)
+	return data, err
+}
+
+// doRequestStatus is doRequestWith also returning the HTTP status of the
+// response, for callers that tell failures apart by it.
+func doRequestStatus(ctx context.Context, client *http.Client, method, url, body string, header http.Header) ([]byte, int, error) {
+	var lastErr error
+	backoff := retryBackoff
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		slog.Debug("➡️  HTTP request", "method", method, "url", url, "body", body, "attempt", attempt)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, 0, err
+			}
+			if isTransient(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			if isTransient(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+
+		slog.Debug("⬅️  HTTP response", "status", resp.StatusCode, "body", string(data))
+		// Retrying right away would only make it worse, callers slow down
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, resp.StatusCode, fmt.Errorf("%s %s: %w", method, url, ErrRateLimited)
+		}
+		return data, resp.StatusCode, nil
+	}
+
+	return nil, 0, fmt.Errorf("%s %s failed after %d attempts: %v", method, url, maxAttempts, lastErr)
+}
+
+// isTransient reports whether a request error is worth retrying.
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,77 @@
+package hue
+
+// Light is a light, or a room or zone of lights driven with a single group
+// call.
+type Light struct {
+	ID   string
+	Name string
+	// Type is the Hue light type, e.g. "Extended color light".
+	Type string
+	// SupportsColor is set for lights that accept hue/sat.
+	SupportsColor bool
+	// SupportsColorTemp is set for tunable white lights accepting ct.
+	SupportsColorTemp bool
+	// SupportsDimming is cleared for plugs and other on/off accessories,
+	// which only follow brightness by switching on and off.
+	SupportsDimming bool
+	// Reachable is cleared for lights the bridge can't talk to, e.g.
+	// switched off at the wall.
+	Reachable bool
+	// Group is set when the target is a room or zone driven with a single
+	// group call rather than a single light, made of the LightIDs.
+	Group    bool
+	LightIDs []string
+}
+
+// Key tells the target apart from a light or group sharing the same ID.
+func (l Light) Key() string {
+	if l.Group {
+		return "group/" + l.ID
+	}
+	return l.ID
+}
+
+// Kind describes what the light can do, for display.
+func (l Light) Kind() string {
+	switch {
+	case l.Group && l.Type == "Room":
+		return "room"
+	case l.Group && l.Type == "Zone":
+		return "zone"
+	case l.Group:
+		return "group"
+	case l.SupportsColor:
+		return "color"
+	case l.SupportsColorTemp:
+		return "white ambiance"
+	case l.SupportsDimming:
+		return "dimmable"
+	default:
+		return "on/off"
+	}
+}
+
+// path is the v1 resource of a light or group target.
+func (l Light) path() string {
+	if l.Group {
+		return "/groups/" + l.ID
+	}
+	return "/lights/" + l.ID
+}
+
+// v2Path is the v2 resource of a light or group target, a group being
+// driven through its grouped_light.
+func (l Light) v2Path() string {
+	if l.Group {
+		return "/resource/grouped_light/" + l.ID
+	}
+	return "/resource/light/" + l.ID
+}
+
+// statePath is where v1 state changes of a light or group target go.
+func (l Light) statePath() string {
+	if l.Group {
+		return l.path() + "/action"
+	}
+	return l.path() + "/state"
+}
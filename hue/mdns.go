@@ -0,0 +1,140 @@
+package hue
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// hueService is the mDNS service type advertised by Hue bridges.
+const hueService = "_hue._tcp.local."
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DiscoverMDNS queries the local network for Hue bridges over mDNS and
+// returns the IPs of every bridge that answered within the timeout. Bridges
+// on the same subnet as one of our interfaces come first.
+func DiscoverMDNS(timeout time.Duration) ([]string, error) {
+	// Querying from an ephemeral port makes responders answer us directly
+	// (legacy unicast), so we don't need to join the multicast group.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	defer conn.Close()
+
+	query, err := buildMDNSQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteToUDP(query, mdnsAddr); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The deadline ends the collection window
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("failed to read mDNS response: %v", err)
+		}
+
+		for _, ip := range parseMDNSResponse(buf[:n]) {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	return preferLocalSubnet(ips), nil
+}
+
+func buildMDNSQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(hueService)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	return msg.Pack()
+}
+
+// parseMDNSResponse returns the IPv4 addresses from a response that
+// advertises the Hue service, and nothing for unrelated mDNS traffic.
+func parseMDNSResponse(packet []byte) []string {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Header.Response {
+		return nil
+	}
+
+	records := append(msg.Answers, msg.Additionals...)
+
+	isHue := false
+	for _, r := range records {
+		if r.Header.Type == dnsmessage.TypePTR && strings.EqualFold(r.Header.Name.String(), hueService) {
+			isHue = true
+			break
+		}
+	}
+	if !isHue {
+		return nil
+	}
+
+	var ips []string
+	for _, r := range records {
+		if a, ok := r.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(a.A[:]).String())
+		}
+	}
+
+	return ips
+}
+
+// preferLocalSubnet moves the IPs that are on one of our interfaces'
+// subnets to the front, keeping the order otherwise.
+func preferLocalSubnet(ips []string) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+
+	var local, other []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		onSubnet := false
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(parsed) {
+				onSubnet = true
+				break
+			}
+		}
+		if onSubnet {
+			local = append(local, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+
+	return append(local, other...)
+}
@@ -0,0 +1,71 @@
+package hue
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/tidwall/gjson"
+)
+
+// Scene is a scene stored on the bridge.
+type Scene struct {
+	ID   string
+	Name string
+	// Group is the room or zone the scene belongs to. v1 light scenes
+	// have none and are recalled on the group of all lights.
+	Group string
+}
+
+// Scenes returns the scenes stored on the bridge.
+func (c *Client) Scenes() ([]Scene, error) {
+	var scenes []Scene
+	if c.UseV2 {
+		body, err := c.v2Request("GET", "/resource/scene", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get scenes: %v", err)
+		}
+		gjson.GetBytes(body, "data").ForEach(func(_, value gjson.Result) bool {
+			scenes = append(scenes, Scene{
+				ID:    value.Get("id").String(),
+				Name:  value.Get("metadata.name").String(),
+				Group: value.Get("group.rid").String(),
+			})
+			return true
+		})
+		return scenes, nil
+	}
+
+	body, err := c.v1Request("GET", "/scenes", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenes: %v", err)
+	}
+	gjson.ParseBytes(body).ForEach(func(key, value gjson.Result) bool {
+		scenes = append(scenes, Scene{
+			ID:    key.String(),
+			Name:  value.Get("name").String(),
+			Group: value.Get("group").String(),
+		})
+		return true
+	})
+	return scenes, nil
+}
+
+// RecallScene activates a scene on the lights it was saved for.
+func (c *Client) RecallScene(scene Scene) error {
+	if c.DryRun {
+		slog.Info(fmt.Sprintf("🧪 Recall scene %s (%s)", scene.Name, scene.ID))
+		return nil
+	}
+
+	if c.UseV2 {
+		_, err := c.v2Request("PUT", "/resource/scene/"+scene.ID, `{"recall":{"action":"active"}}`)
+		return err
+	}
+
+	group := scene.Group
+	if group == "" {
+		group = "0"
+	}
+	_, err := c.v1Request("PUT", "/groups/"+group+"/action", fmt.Sprintf(`{"scene":"%s"}`, scene.ID))
+	return err
+}
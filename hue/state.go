@@ -0,0 +1,292 @@
+package hue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// LightState is a snapshot of the parts of a light's state that huemidi
+// changes, so the light can be put back the way it was after a session.
+type LightState struct {
+	On bool
+	// Bri, Hue and Sat are nil when the light doesn't report them.
+	Bri *int
+	Hue *int
+	Sat *int
+	// XY is the CIE color on the v2 API, which has no hue/sat.
+	XY *[2]float64
+	// CT is the white in mireds, only set when the light was showing a
+	// color temperature rather than a color.
+	CT *int
+}
+
+// CaptureState snapshots a light so it can be restored later.
+func (c *Client) CaptureState(light *Light) (*LightState, error) {
+	if c.UseV2 {
+		return c.captureStateV2(light)
+	}
+
+	body, err := c.v1Request("GET", light.path(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get light state: %v", err)
+	}
+
+	// Groups report the last state sent to all their lights as "action"
+	field := "state"
+	if light.Group {
+		field = "action"
+	}
+	state := gjson.GetBytes(body, field)
+	if !state.Exists() {
+		return nil, fmt.Errorf("light %s has no state", light.Name)
+	}
+
+	optional := func(field string) *int {
+		value := state.Get(field)
+		if !value.Exists() {
+			return nil
+		}
+		v := int(value.Int())
+		return &v
+	}
+
+	captured := &LightState{
+		On:  state.Get("on").Bool(),
+		Bri: optional("bri"),
+		Hue: optional("hue"),
+		Sat: optional("sat"),
+	}
+	// A light in ct mode still reports the hue/sat of its last color
+	if state.Get("colormode").String() == "ct" {
+		captured.CT = optional("ct")
+	}
+	return captured, nil
+}
+
+// RestoreState puts a light back in a state returned by CaptureState.
+func (c *Client) RestoreState(light *Light, state *LightState) error {
+	if c.UseV2 {
+		return c.restoreStateV2(light, state)
+	}
+
+	// The bridge refuses changes to bri/hue/sat/ct on a light that is off, so
+	// those are only sent together with "on":true.
+	fields := []string{fmt.Sprintf(`"on":%t`, state.On)}
+	if state.On {
+		if state.Bri != nil {
+			fields = append(fields, fmt.Sprintf(`"bri":%d`, *state.Bri))
+		}
+		if state.CT != nil {
+			fields = append(fields, fmt.Sprintf(`"ct":%d`, *state.CT))
+		} else {
+			if state.Hue != nil {
+				fields = append(fields, fmt.Sprintf(`"hue":%d`, *state.Hue))
+			}
+			if state.Sat != nil {
+				fields = append(fields, fmt.Sprintf(`"sat":%d`, *state.Sat))
+			}
+		}
+	}
+	requestBody := "{" + strings.Join(fields, ",") + "}"
+
+	return c.SetState(light, requestBody)
+}
+
+// LightUpdate changes several properties of a light in a single request,
+// so that a brightness and a color set together don't take two round
+// trips or flicker in between. Nil fields are left as they are.
+type LightUpdate struct {
+	// On switches the light on or off. A brightness above 0 or a color
+	// switches it on too.
+	On *bool
+	// Brightness is a percentage, 0 switching the light off.
+	Brightness *int
+	// Hue (0-65535) and Sat (0-254) set a color, ColorTemp a white in
+	// mireds.
+	Hue       *int
+	Sat       *int
+	ColorTemp *int
+
+	StateOptions
+}
+
+// BrightnessUpdate sets a brightness percentage, 0 switching the light
+// off.
+func BrightnessUpdate(brightness int, stateOpts StateOptions) LightUpdate {
+	return LightUpdate{Brightness: &brightness, StateOptions: stateOpts}
+}
+
+// ColorUpdate sets the hue (0-65535) and saturation (0-254).
+func ColorUpdate(hue, sat int) LightUpdate {
+	return LightUpdate{Hue: &hue, Sat: &sat}
+}
+
+// SaturationUpdate sets only the saturation (0-254), keeping the hue.
+func SaturationUpdate(sat int) LightUpdate {
+	return LightUpdate{Sat: &sat}
+}
+
+// ColorTempUpdate sets a white color temperature, in mireds.
+func ColorTempUpdate(mireds int) LightUpdate {
+	return LightUpdate{ColorTemp: &mireds}
+}
+
+// Merge adds the changes of a later update, ending up where sending both
+// in turn would. A color switches back on a light the update switched
+// off, switching off drops the colors, which the bridge refuses on a
+// light that is off, and a color replaces a white and the other way
+// round.
+func (u *LightUpdate) Merge(later LightUpdate) {
+	if later.colored() && u.off() {
+		u.On, u.Brightness = nil, nil
+	}
+
+	if later.On != nil || later.Brightness != nil {
+		u.Transition = later.Transition
+	}
+	if later.On != nil {
+		u.On = later.On
+	}
+	if later.Brightness != nil {
+		u.Brightness = later.Brightness
+	}
+
+	if later.Hue != nil || later.Sat != nil {
+		u.ColorTemp = nil
+	}
+	if later.Hue != nil {
+		u.Hue = later.Hue
+	}
+	if later.Sat != nil {
+		u.Sat = later.Sat
+	}
+	if later.ColorTemp != nil {
+		u.Hue, u.Sat, u.ColorTemp = nil, nil, later.ColorTemp
+	}
+
+	if u.off() {
+		u.Hue, u.Sat, u.ColorTemp = nil, nil, nil
+	}
+}
+
+// off reports whether the update switches the light off.
+func (u LightUpdate) off() bool {
+	return (u.On != nil && !*u.On) || (u.Brightness != nil && *u.Brightness == 0)
+}
+
+// colored reports whether the update sets a color or a white.
+func (u LightUpdate) colored() bool {
+	return u.Hue != nil || u.Sat != nil || u.ColorTemp != nil
+}
+
+// turnsOn reports whether the update switches the light on. Changing
+// only the saturation leaves it as it is.
+func (u LightUpdate) turnsOn() bool {
+	return !u.off() && ((u.On != nil && *u.On) || u.Brightness != nil || u.Hue != nil || u.ColorTemp != nil)
+}
+
+// SetLightState applies an update in one request. An empty update sends
+// nothing.
+func (c *Client) SetLightState(light *Light, update LightUpdate) error {
+	if c.Metrics != nil && update.Brightness != nil {
+		defer func(start time.Time) { c.Metrics.SetBrightness(time.Since(start)) }(time.Now())
+	}
+
+	// Plugs ignore or reject a brightness, they can only be switched
+	if !light.SupportsDimming && update.Brightness != nil {
+		on := *update.Brightness > 0
+		update.On, update.Brightness, update.Transition = &on, nil, 0
+	}
+
+	var fields []string
+	if c.UseV2 {
+		var err error
+		if fields, err = update.v2Fields(); err != nil {
+			return err
+		}
+	} else {
+		fields = update.v1Fields()
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return c.SetState(light, "{"+strings.Join(fields, ",")+"}")
+}
+
+// v1Fields returns the members of the v1 state body of the update.
+func (u LightUpdate) v1Fields() []string {
+	var fields []string
+	switch {
+	case u.off():
+		fields = append(fields, `"on":false`)
+	case u.turnsOn():
+		fields = append(fields, `"on":true`)
+	}
+	if !u.off() {
+		if u.Brightness != nil {
+			fields = append(fields, fmt.Sprintf(`"bri":%d`, hueBrightness(*u.Brightness)))
+		}
+		if u.Hue != nil {
+			fields = append(fields, fmt.Sprintf(`"hue":%d`, *u.Hue))
+		}
+		if u.Sat != nil {
+			fields = append(fields, fmt.Sprintf(`"sat":%d`, *u.Sat))
+		}
+		if u.ColorTemp != nil {
+			fields = append(fields, fmt.Sprintf(`"ct":%d`, *u.ColorTemp))
+		}
+	}
+	if u.Transition > 0 && len(fields) > 0 {
+		fields = append(fields, fmt.Sprintf(`"transitiontime":%d`, u.transitionTime()))
+	}
+	return fields
+}
+
+// v2Fields returns the members of the v2 light body of the update. v2
+// has no saturation of its own, so changing it needs the hue too.
+func (u LightUpdate) v2Fields() ([]string, error) {
+	var fields []string
+	switch {
+	case u.off():
+		fields = append(fields, `"on":{"on":false}`)
+	case u.turnsOn():
+		fields = append(fields, `"on":{"on":true}`)
+	}
+	if !u.off() {
+		if u.Brightness != nil {
+			fields = append(fields, fmt.Sprintf(`"dimming":{"brightness":%d}`, *u.Brightness))
+		}
+		switch {
+		case u.Hue != nil:
+			// Colors are set in CIE xy space
+			sat := MaxSat
+			if u.Sat != nil {
+				sat = *u.Sat
+			}
+			x, y := hueSatToXY(*u.Hue, sat)
+			fields = append(fields, fmt.Sprintf(`"color":{"xy":{"x":%.4f,"y":%.4f}}`, x, y))
+		case u.Sat != nil:
+			return nil, ErrSaturationUnsupported
+		case u.ColorTemp != nil:
+			fields = append(fields, fmt.Sprintf(`"color_temperature":{"mirek":%d}`, *u.ColorTemp))
+		}
+	}
+	if u.Transition > 0 && len(fields) > 0 {
+		// v2 takes milliseconds, keep the same 100ms steps as v1
+		fields = append(fields, fmt.Sprintf(`"dynamics":{"duration":%d}`, u.transitionTime()*100))
+	}
+	return fields, nil
+}
+
+// hueBrightness converts a brightness percentage to the v1 scale (1-254).
+func hueBrightness(brightness int) int {
+	bri := int(float64(brightness) * 254.0 / 100.0)
+	if bri < 1 && brightness > 0 {
+		bri = 1 // Minimum brightness when not off
+	}
+	return bri
+}
@@ -0,0 +1,1407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+	"gitlab.com/gomidi/midi/v2/drivers"
+
+	"huemidi/hue"
+	"huemidi/midimap"
+)
+
+// groupThrottle is the minimum delay between two group actions, the bridge
+// handling far fewer of them than light updates.
+const groupThrottle = time.Second
+
+// offLevel is the level of a light that is switched off. Other levels are a
+// brightness percentage, a hue or a color temperature depending on the
+// mode.
+const offLevel = -1
+
+// onLevel is the level of a light switched on from another app, at a
+// level we don't know. Putting it back only switches the light on.
+const onLevel = -2
+
+// externalChangeGrace is how long after sending an update events for the
+// light are assumed to be the bridge echoing it.
+const externalChangeGrace = time.Second
+
+// idleFade is the shortest transition into and out of the idle level, so
+// the lights go out gently even without -fade.
+const idleFade = 3 * time.Second
+
+// deadbandSettle is how long the fader has to rest before a move held back
+// by -deadband is sent anyway, so the lights end up where it stopped.
+const deadbandSettle = 300 * time.Millisecond
+
+// sustainPedal is the Control Change number of the sustain pedal.
+const sustainPedal = 64
+
+// KeyRange is an inclusive range of MIDI notes.
+type KeyRange struct {
+	Low  uint8
+	High uint8
+}
+
+// Contains reports whether key falls within the range.
+func (r KeyRange) Contains(key uint8) bool {
+	return key >= r.Low && key <= r.High
+}
+
+func (r KeyRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// LightZone binds a range of keys to the light they control. Within the
+// range, keys map to levels just like a calibration does for the whole
+// keyboard.
+type LightZone struct {
+	Range KeyRange
+	Light hue.Light
+
+	// The zones of -targets may have no keys, a controller of their own
+	// (0 for none) and their own Mode* constant (empty for the one in
+	// use).
+	NoKeys bool
+	CC     int
+	Mode   string
+}
+
+// heldNote is a key held down on a light and the level it maps to.
+type heldNote struct {
+	key   uint8
+	level int
+}
+
+// lightLevel is what the listener knows about one light.
+type lightLevel struct {
+	// held are the keys currently down for the light, in the order they
+	// were pressed.
+	held []heldNote
+	// restore is the level releasing every held key brings back in
+	// momentary mode.
+	restore int
+	// current is the level last sent to the light.
+	current int
+
+	// sentOn is whether the light was last switched on, at toggledAt,
+	// for -toggle-cooldown. toggleTimer sends the switch held back until
+	// the cooldown is over.
+	sentOn      bool
+	toggledAt   time.Time
+	toggleTimer *time.Timer
+}
+
+// press records a key going down.
+func (s *lightLevel) press(key uint8, level int) {
+	s.release(key)
+	s.held = append(s.held, heldNote{key: key, level: level})
+}
+
+// release forgets a key, reporting whether it was held.
+func (s *lightLevel) release(key uint8) bool {
+	for i, note := range s.held {
+		if note.key == key {
+			s.held = append(s.held[:i], s.held[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate returns the level the held keys add up to, as -chord-mode
+// says in brightness mode. By default the last key pressed wins, max
+// keeps chords from flickering between their notes in arrival order;
+// colors can't be ranked, so the last key pressed always wins.
+func (s *lightLevel) aggregate(mode, chordMode string) int {
+	level := s.held[len(s.held)-1].level
+	if mode != ModeBrightness {
+		return level
+	}
+
+	sum := 0
+	for _, note := range s.held {
+		switch chordMode {
+		case ChordMax:
+			level = max(level, note.level)
+		case ChordMin:
+			level = min(level, note.level)
+		}
+		sum += note.level
+	}
+	if chordMode == ChordAverage {
+		level = int(math.Round(float64(sum) / float64(len(s.held))))
+	}
+	return level
+}
+
+// lightSetter changes the levels of the lights, through REST calls or an
+// entertainment stream.
+type lightSetter interface {
+	SetLightState(light *hue.Light, update hue.LightUpdate) error
+}
+
+// midiListener turns MIDI messages into light updates. Every light keeps
+// its own level so that zones can drive lights independently.
+type midiListener struct {
+	client *hue.Client
+	// out receives the levels, the client itself unless streaming.
+	out lightSetter
+
+	lights      []hue.Light
+	zones       []LightZone
+	scenes      map[uint8]hue.Scene
+	calibration *midimap.Calibration
+	opts        *Options
+
+	// bindings, when loaded from a file, replace the usual handling of
+	// every message.
+	bindings map[bindingKey]*Binding
+
+	useNotes bool
+	useCC    bool
+
+	// transition is the time.Duration of brightness transitions, from
+	// -fade until -transition-cc is moved.
+	transition atomic.Int64
+
+	// Updates go through a per-light throttle so fast playing doesn't
+	// flood the bridge, which handles roughly 10 commands per second.
+	throttler *Throttler
+
+	// updates holds the changes of each light waiting for the throttle,
+	// merged so that a brightness and a color played within an interval
+	// go out in one request instead of the latest replacing the other.
+	updatesMu sync.Mutex
+	updates   map[string]*hue.LightUpdate
+
+	// ramper glides key brightnesses with -ramp, nil otherwise.
+	ramper *Ramper
+
+	// dashboard shows the lights with -tui, nil otherwise.
+	dashboard *Dashboard
+
+	// lastSent is when we last sent an update, to tell our own changes
+	// apart from external ones on the event stream.
+	lastSent atomic.Int64
+
+	// bendOffset is the brightness percentage added by the pitch-bend
+	// wheel, 0 when it rests at the center.
+	bendOffset atomic.Int64
+
+	// saturation is driven by aftertouch, full until the keyboard sends
+	// any pressure.
+	saturation     atomic.Int64
+	warnSaturation sync.Once
+
+	// warnRateLimit tells once that the bridge is slowing us down.
+	warnRateLimit sync.Once
+
+	// padHue and padSat are set by -hue-cc and -sat-cc, the saturation
+	// being full until its CC is moved.
+	padHue atomic.Int64
+	padSat atomic.Int64
+
+	// lastNote is when the previous key was pressed, to spot the fast
+	// repeats that trigger a strobe.
+	lastNote atomic.Int64
+
+	// currentMode is the Mode* constant in use, switched live by program
+	// changes.
+	currentMode atomic.Value
+
+	// frozen is set while the sustain pedal is down, keys are ignored
+	// until it is released.
+	frozen atomic.Bool
+
+	// latched is toggled by each press of the -latch-cc switch, holding
+	// the brightness like the sustain pedal but across releases.
+	// latchDown tells presses apart from releases.
+	latched   atomic.Bool
+	latchDown atomic.Bool
+
+	// idle fires after -idle-timeout without MIDI input, nil when
+	// disabled. idling is set once the lights faded to the idle level,
+	// and fadeIn while the message waking them up is handled, so its
+	// updates fade back in.
+	idle   *time.Timer
+	idling atomic.Bool
+	fadeIn atomic.Bool
+
+	// heldKeys are the keys down on the whole keyboard, which make up a
+	// chord once chordTimer fires.
+	heldKeys   map[uint8]bool
+	chordTimer *time.Timer
+
+	// faderSent is the fader brightness last sent with -deadband, -1
+	// before the first, and deadbandTimer sends the one held back.
+	faderSent     int
+	deadbandTimer *time.Timer
+
+	mu     sync.Mutex
+	levels map[string]*lightLevel
+}
+
+func newMIDIListener(client *hue.Client, stream *hue.Stream, lights []hue.Light, zones []LightZone, scenes map[uint8]hue.Scene, calibration *midimap.Calibration, opts *Options) *midiListener {
+	l := &midiListener{
+		client:      client,
+		out:         client,
+		lights:      lights,
+		zones:       zones,
+		scenes:      scenes,
+		calibration: calibration,
+		opts:        opts,
+		useNotes:    opts.Control != ControlCC,
+		useCC:       opts.Control != ControlNotes,
+		levels:      make(map[string]*lightLevel),
+		heldKeys:    make(map[uint8]bool),
+		updates:     make(map[string]*hue.LightUpdate),
+		faderSent:   -1,
+	}
+	l.transition.Store(int64(opts.Fade))
+	if len(opts.Bindings) > 0 {
+		l.bindings = indexBindings(opts.Bindings)
+	}
+
+	// The stream sends frames at its own pace, levels only update them
+	throttle := opts.Throttle
+	if stream != nil {
+		l.out = stream
+		throttle = 0
+	}
+
+	l.throttler = newThrottler(throttle, func(err error) {
+		switch {
+		case hue.IsRateLimited(err):
+			// Dropped updates are fine, the next one carries the latest level
+			l.throttler.SlowDown()
+			l.warnRateLimit.Do(func() {
+				slog.Warn("⚠️  The bridge is rate limiting us, slowing down updates; play slower or raise -throttle")
+			})
+			slog.Debug("Rate limited by the bridge", "err", err)
+		case hue.IsBridgeError(err, hue.ErrTypeUnauthorized):
+			slog.Error(fmt.Sprintf("❌ The bridge no longer accepts our username, run with -reset-config to pair again: %v", err))
+		case hue.IsBridgeError(err, hue.ErrTypeUnavailable):
+			slog.Warn(fmt.Sprintf("⚠️  Light unreachable, is it powered on? %v", err))
+		default:
+			slog.Error(fmt.Sprintf("❌ Failed to update light: %v", err))
+		}
+	})
+	if opts.Ramp > 0 {
+		// One step per throttle interval, so each step is really sent
+		l.ramper = newRamper(opts.Ramp, opts.Throttle, func(light *hue.Light, brightness int) {
+			l.update(light, hue.BrightnessUpdate(brightness, l.stateOptions()))
+		})
+	}
+	for _, light := range lights {
+		if light.Group && opts.Throttle > 0 {
+			l.throttler.SetInterval(light.Key(), max(opts.Throttle, groupThrottle))
+		}
+	}
+	l.saturation.Store(hue.MaxSat)
+	l.padSat.Store(hue.MaxSat)
+	l.currentMode.Store(opts.Mode)
+
+	// The lights count as off since we don't know their state yet
+	for _, light := range lights {
+		l.levels[light.Key()] = &lightLevel{restore: offLevel, current: offLevel}
+	}
+
+	return l
+}
+
+func startMIDIListener(client *hue.Client, stream *hue.Stream, lights []hue.Light, zones []LightZone, scenes map[uint8]hue.Scene, ins []drivers.In, calibration *midimap.Calibration, opts *Options, refresh func() ([]hue.Light, error)) error {
+	l := newMIDIListener(client, stream, lights, zones, scenes, calibration, opts)
+
+	switch {
+	case len(ins) == 0 && opts.Replay == nil:
+		fmt.Println("🎵 Starting OSC listener... Move your /brightness fader to control brightness!")
+	case l.bindings != nil:
+		fmt.Println("🎵 Starting MIDI listener... Play the bound keys and controls!")
+		for _, binding := range opts.Bindings {
+			fmt.Printf("   %s %d = %s\n", binding.Match, binding.Number, binding.describe())
+		}
+	case !l.useNotes:
+		fmt.Println("🎵 Starting MIDI listener... Move your fader or knob to control brightness!")
+	case len(zones) > 0:
+		fmt.Println("🎵 Starting MIDI listener... Each key range controls its own light!")
+		for _, zone := range zones {
+			description := zone.describe()
+			fmt.Printf("   %s%s → %s\n", strings.ToUpper(description[:1]), description[1:], zone.Light.Name)
+		}
+	case opts.Mode == ModeColor:
+		zeroKey, fullKey := calibration.Ends()
+		fmt.Println("🎵 Starting MIDI listener... Press keys to control color!")
+		fmt.Printf("   Key %d = hue 0\n", zeroKey)
+		fmt.Printf("   Key %d = hue %d\n", fullKey, hue.MaxHue)
+	case opts.Mode == ModeColorTemp:
+		zeroKey, fullKey := calibration.Ends()
+		fmt.Println("🎵 Starting MIDI listener... Press keys to control color temperature!")
+		fmt.Printf("   Key %d = warm (%d mireds)\n", zeroKey, hue.MaxColorTemp)
+		fmt.Printf("   Key %d = cool (%d mireds)\n", fullKey, hue.MinColorTemp)
+	default:
+		zeroKey, fullKey := calibration.Ends()
+		if opts.Invert {
+			zeroKey, fullKey = fullKey, zeroKey
+		}
+		fmt.Println("🎵 Starting MIDI listener... Press keys to control brightness!")
+		switch {
+		case opts.PitchClass:
+			zero, full := "C", "B"
+			if calibration.Reversed != opts.Invert {
+				zero, full = full, zero
+			}
+			fmt.Printf("   %s = 0%% brightness, %s = 100%% brightness, in every octave\n", zero, full)
+		default:
+			fmt.Printf("   Key %d = 0%% brightness\n", zeroKey)
+			fmt.Printf("   Key %d = 100%% brightness\n", fullKey)
+		}
+	}
+	if l.useCC && l.bindings == nil && (len(ins) > 0 || opts.Replay != nil) {
+		fmt.Printf("   CC%d = 0-100%% brightness\n", opts.CC)
+	}
+	if opts.HueCC >= 0 && l.bindings == nil {
+		fmt.Printf("   CC%d = hue 0-%d\n", opts.HueCC, hue.MaxHue)
+	}
+	if opts.SatCC >= 0 && l.bindings == nil {
+		fmt.Printf("   CC%d = saturation 0-%d\n", opts.SatCC, hue.MaxSat)
+	}
+	if opts.LatchCC >= 0 && l.bindings == nil {
+		fmt.Printf("   CC%d = latch the brightness on and off\n", opts.LatchCC)
+	}
+	if opts.TransitionCC >= 0 && l.bindings == nil {
+		fmt.Printf("   CC%d = fade time %s-%s\n", opts.TransitionCC, midimap.MinCCTransition, midimap.MaxCCTransition)
+	}
+	if opts.UpKey >= 0 && l.useNotes && l.bindings == nil {
+		fmt.Printf("   Key %d = %d%% brighter\n", opts.UpKey, opts.Step)
+	}
+	if opts.DownKey >= 0 && l.useNotes && l.bindings == nil {
+		fmt.Printf("   Key %d = %d%% dimmer\n", opts.DownKey, opts.Step)
+	}
+	if opts.Momentary {
+		fmt.Println("   Momentary mode: releasing a key restores the previous state")
+	}
+	notes := make([]int, 0, len(scenes))
+	for note := range scenes {
+		notes = append(notes, int(note))
+	}
+	sort.Ints(notes)
+	for _, note := range notes {
+		fmt.Printf("   Key %d = scene %s\n", note, scenes[uint8(note)].Name)
+	}
+	chordSets := make([]int, 0, len(opts.Chords))
+	for set := range opts.Chords {
+		chordSets = append(chordSets, int(set))
+	}
+	sort.Ints(chordSets)
+	for _, set := range chordSets {
+		chord := opts.Chords[pitchSet(set)]
+		fmt.Printf("   Chord %s = %s\n", chord.Chord, chord.describe())
+	}
+	if len(opts.ProgramModes) > 0 {
+		programs := make([]int, 0, len(opts.ProgramModes))
+		for program := range opts.ProgramModes {
+			programs = append(programs, int(program))
+		}
+		sort.Ints(programs)
+		for _, program := range programs {
+			fmt.Printf("   Program %d = %s mode\n", program, opts.ProgramModes[uint8(program)])
+		}
+	}
+	fmt.Println("   Press Ctrl+C to exit, send SIGHUP to refresh the lights")
+
+	for i, in := range ins {
+		port, err := reopenMIDIDevice(in)
+		if err != nil {
+			return err
+		}
+		ins[i] = port
+	}
+
+	defer l.throttler.Stop()
+	if l.ramper != nil {
+		defer l.ramper.Stop()
+	}
+
+	// Follow changes made from other apps so that the levels match what
+	// the lights are really doing.
+	if opts.Events {
+		if !client.UseV2 {
+			slog.Warn("⚠️  The event stream needs the Hue API v2, external changes won't be tracked")
+		} else {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go hue.WatchEvents(ctx, client, lights, hue.NewLightCache(), l.handleExternalChange)
+		}
+	}
+
+	if opts.HTTPAddr != "" {
+		stopServer, err := l.serveHTTP(opts.HTTPAddr)
+		if err != nil {
+			return err
+		}
+		defer stopServer()
+	}
+
+	if opts.OSCAddr != "" {
+		stopOSC, err := l.serveOSC(opts.OSCAddr)
+		if err != nil {
+			return err
+		}
+		defer stopOSC()
+	}
+
+	if opts.TUI {
+		dashboard, stopDashboard := startDashboard(logLevel(opts.Verbose, opts.Quiet))
+		defer stopDashboard()
+		l.dashboard = dashboard
+		dashboard.Update(l.snapshot(""))
+	}
+
+	if opts.IdleTimeout > 0 {
+		l.idle = time.AfterFunc(opts.IdleTimeout, l.goIdle)
+		defer l.idle.Stop()
+	}
+
+	// Keep listening if a device is unplugged and plugged back in
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Messages of all the devices go to the same handler
+	handle := l.handle
+	if opts.Record != "" {
+		rec, err := newRecorder(opts.Record)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				slog.Error(fmt.Sprintf("❌ %v", err))
+			}
+		}()
+		handle = func(msg midi.Message, timestampms int32) {
+			rec.record(msg)
+			l.handle(msg, timestampms)
+		}
+		fmt.Printf("⏺️  Recording MIDI messages to %s\n", opts.Record)
+	}
+	for _, in := range ins {
+		conn, err := listenMIDI(in, handle)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		go conn.watch(ctx)
+	}
+
+	// A replay goes through the same handler as live messages, the
+	// lights stay as it left them until exiting
+	if opts.Replay != nil {
+		go replay(ctx, opts.Replay, recoverMIDI(handle))
+	}
+
+	// SIGHUP picks up lights added to the bridge since
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				l.refreshLights(refresh)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	waitForExit()
+
+	return nil
+}
+
+// send queues an update for one light.
+func (l *midiListener) send(light *hue.Light, update func(ctx context.Context, light *hue.Light) error) {
+	l.throttler.Send(light.Key(), func(ctx context.Context) error {
+		defer l.lastSent.Store(time.Now().UnixNano())
+
+		if err := update(ctx, light); err != nil {
+			return fmt.Errorf("%s: %w", light.Name, err)
+		}
+		return nil
+	})
+}
+
+// update queues changes to a light, merged with those still waiting for
+// the throttle, so that everything played within an interval goes out in
+// a single request.
+func (l *midiListener) update(light *hue.Light, update hue.LightUpdate) {
+	key := light.Key()
+	l.updatesMu.Lock()
+	if pending, ok := l.updates[key]; ok {
+		pending.Merge(update)
+	} else {
+		l.updates[key] = &update
+	}
+	l.updatesMu.Unlock()
+
+	l.send(light, func(ctx context.Context, light *hue.Light) error {
+		l.updatesMu.Lock()
+		pending, ok := l.updates[key]
+		delete(l.updates, key)
+		l.updatesMu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		err := l.setter(ctx).SetLightState(light, *pending)
+		switch {
+		case errors.Is(err, hue.ErrSaturationUnsupported):
+			l.warnSaturation.Do(func() {
+				slog.Warn("⚠️  Aftertouch only changes saturation in color mode on the v2 API")
+			})
+			return nil
+		case err != nil && ctx.Err() != nil:
+			// Superseded midway, the newer request carries these changes
+			// too
+			l.updatesMu.Lock()
+			if newer, ok := l.updates[key]; ok {
+				pending.Merge(*newer)
+				l.updates[key] = pending
+			}
+			l.updatesMu.Unlock()
+		}
+		return err
+	})
+}
+
+// toggle switches every light to the opposite of what it reports.
+func (l *midiListener) toggle() {
+	l.sendAll(func(ctx context.Context, light *hue.Light) error {
+		state, err := l.client.WithContext(ctx).CaptureState(light)
+		if err != nil {
+			return err
+		}
+		if err := l.client.WithContext(ctx).SetOn(light, !state.On); err != nil {
+			return err
+		}
+
+		// A light switched off counts as off, as after any key doing it
+		if state.On {
+			l.mu.Lock()
+			l.levels[light.Key()].current = offLevel
+			l.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// recallScene queues a scene recall, which changes the lights of the
+// scene all at once.
+func (l *midiListener) recallScene(scene hue.Scene) {
+	l.throttler.Send("scene", func(ctx context.Context) error {
+		defer l.lastSent.Store(time.Now().UnixNano())
+		if err := l.client.WithContext(ctx).RecallScene(scene); err != nil {
+			return fmt.Errorf("scene %s: %v", scene.Name, err)
+		}
+		return nil
+	})
+}
+
+// sendAll fans an update out to every light; a failing light doesn't hold
+// back the others.
+func (l *midiListener) sendAll(update func(ctx context.Context, light *hue.Light) error) {
+	for _, light := range l.currentLights() {
+		l.send(light, update)
+	}
+}
+
+// setter is where updates sent with ctx go: the stream, or the client
+// bound to ctx so that stale requests can be canceled.
+func (l *midiListener) setter(ctx context.Context) lightSetter {
+	if stream, ok := l.out.(*hue.Stream); ok {
+		return stream
+	}
+	return l.client.WithContext(ctx)
+}
+
+// currentLights returns the lights being controlled, which a refresh may
+// replace at any time.
+func (l *midiListener) currentLights() []*hue.Light {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lights := make([]*hue.Light, len(l.lights))
+	for i := range l.lights {
+		lights[i] = &l.lights[i]
+	}
+	return lights
+}
+
+// refreshLights replaces the lights being controlled with the ones
+// refresh selects, keeping the levels of those already known. Zones and
+// entertainment areas are set up for the lights picked at startup, so
+// they keep them.
+func (l *midiListener) refreshLights(refresh func() ([]hue.Light, error)) {
+	if _, streaming := l.out.(*hue.Stream); streaming || len(l.zones) > 0 {
+		slog.Warn("⚠️  -zones and -stream keep the lights picked at startup, restart to change them")
+		return
+	}
+
+	lights, err := refresh()
+	if err != nil {
+		slog.Error(fmt.Sprintf("❌ Failed to refresh the lights: %v", err))
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, light := range lights {
+		if _, ok := l.levels[light.Key()]; !ok {
+			l.levels[light.Key()] = &lightLevel{restore: offLevel, current: offLevel}
+		}
+		if light.Group && l.opts.Throttle > 0 {
+			l.throttler.SetInterval(light.Key(), max(l.opts.Throttle, groupThrottle))
+		}
+	}
+	l.lights = lights
+}
+
+// goIdle fades the lights that are on to the idle level, once no MIDI
+// input arrived for -idle-timeout.
+func (l *midiListener) goIdle() {
+	l.idling.Store(true)
+	stateOpts := hue.StateOptions{Transition: max(l.stateOptions().Transition, idleFade)}
+	brightness := l.opts.IdleBrightness
+
+	var lit []*hue.Light
+	l.mu.Lock()
+	for i := range l.lights {
+		state := l.levels[l.lights[i].Key()]
+		if state.current == offLevel {
+			continue
+		}
+		lit = append(lit, &l.lights[i])
+
+		// Levels are colors in the other modes, which the fade keeps
+		switch {
+		case brightness == 0:
+			state.current = offLevel
+		case l.mode() == ModeBrightness:
+			state.current = brightness
+		}
+	}
+	l.mu.Unlock()
+
+	for _, light := range lit {
+		emitEvent("light_changed", "id", light.Key(), "name", light.Name, "mode", ModeBrightness, "level", brightness, "idle", true)
+		if brightness == 0 {
+			l.update(light, hue.BrightnessUpdate(0, stateOpts))
+		} else {
+			l.update(light, hue.BrightnessUpdate(l.bound(brightness), stateOpts))
+		}
+	}
+	slog.Info(fmt.Sprintf("💤 No MIDI input for %s, fading to %d%% brightness", l.opts.IdleTimeout, brightness))
+}
+
+// applyLevel sends a level to a light, applying the pitch-bend offset and
+// the aftertouch saturation.
+func (l *midiListener) applyLevel(light *hue.Light, level int) {
+	if l.opts.ToggleCooldown > 0 && l.holdToggle(light, level) {
+		return
+	}
+
+	l.emitLevel(light, level)
+	if level == onLevel {
+		on := true
+		l.update(light, hue.LightUpdate{On: &on})
+		return
+	}
+	offset := int(l.bendOffset.Load())
+	sat := int(l.saturation.Load())
+	mode := l.lightMode(light)
+	stateOpts := l.stateOptions()
+	if l.fadeIn.Load() {
+		stateOpts.Transition = max(stateOpts.Transition, idleFade)
+	}
+
+	if l.ramper != nil && mode == ModeBrightness && light.SupportsDimming {
+		brightness := 0
+		if level != offLevel || offset > 0 {
+			brightness = l.bound(midimap.ClampBrightness(max(level, 0) + offset))
+		}
+		l.ramper.Move(light, brightness)
+		return
+	}
+
+	switch {
+	case level == offLevel && offset <= 0:
+		l.update(light, hue.BrightnessUpdate(0, stateOpts))
+	case !supportsMode(*light, mode):
+		// Lights that can't follow a mode switched to live are left
+		// alone until it changes back.
+	case mode == ModeColor:
+		l.update(light, hue.ColorUpdate(midimap.ClampHue(level), sat))
+	case mode == ModeColorTemp:
+		l.update(light, hue.ColorTempUpdate(midimap.ClampColorTemp(level)))
+	default:
+		l.update(light, hue.BrightnessUpdate(l.bound(midimap.ClampBrightness(max(level, 0)+offset)), stateOpts))
+	}
+}
+
+// levelOn reports whether a level leaves the light switched on.
+func (l *midiListener) levelOn(light *hue.Light, level int) bool {
+	offset := int(l.bendOffset.Load())
+	if level == offLevel && offset <= 0 {
+		return false
+	}
+	if level == onLevel {
+		return true
+	}
+	return l.lightMode(light) != ModeBrightness || l.bound(midimap.ClampBrightness(max(level, 0)+offset)) > 0
+}
+
+// holdToggle reports whether a level switching the light on or off comes
+// within -toggle-cooldown of the previous switch, in which case it is held
+// back. Once the cooldown is over the light gets the level it should be at
+// by then, so a trill ends with the light on or off as it should be
+// however many switches were skipped.
+func (l *midiListener) holdToggle(light *hue.Light, level int) bool {
+	on := l.levelOn(light, level)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, ok := l.levels[light.Key()]
+	if !ok || on == state.sentOn {
+		return false
+	}
+
+	wait := l.opts.ToggleCooldown - time.Since(state.toggledAt)
+	if wait <= 0 {
+		state.sentOn, state.toggledAt = on, time.Now()
+		return false
+	}
+	if state.toggleTimer == nil {
+		state.toggleTimer = time.AfterFunc(wait, func() {
+			l.mu.Lock()
+			state.toggleTimer = nil
+			level, sentOn := state.current, state.sentOn
+			l.mu.Unlock()
+
+			// Back where it was, the switch is dropped
+			if l.levelOn(light, level) != sentOn {
+				l.applyLevel(light, level)
+			}
+		})
+	}
+	return true
+}
+
+// emitLevel reports a new level of a light with -json. Off lights have no
+// level.
+func (l *midiListener) emitLevel(light *hue.Light, level int) {
+	if level == offLevel {
+		emitEvent("light_changed", "id", light.Key(), "name", light.Name, "mode", l.lightMode(light), "off", true)
+		return
+	}
+	if level == onLevel {
+		emitEvent("light_changed", "id", light.Key(), "name", light.Name, "mode", l.lightMode(light), "on", true)
+		return
+	}
+	emitEvent("light_changed", "id", light.Key(), "name", light.Name, "mode", l.lightMode(light), "level", level)
+}
+
+// bound maps a 0-100% brightness into the -min-brightness and
+// -max-brightness range. With a floor above 0 the lights never go off.
+func (l *midiListener) bound(brightness int) int {
+	return l.opts.MinBrightness + brightness*(l.opts.MaxBrightness-l.opts.MinBrightness)/100
+}
+
+// mode returns the Mode* constant currently in use.
+func (l *midiListener) mode() string {
+	return l.currentMode.Load().(string)
+}
+
+// lightMode returns the Mode* constant a light follows, the one in use
+// unless its target says otherwise.
+func (l *midiListener) lightMode(light *hue.Light) string {
+	for i := range l.zones {
+		if l.zones[i].Mode != "" && l.zones[i].Light.Key() == light.Key() {
+			return l.zones[i].Mode
+		}
+	}
+	return l.mode()
+}
+
+func (l *midiListener) describeLevel(mode string, level int) string {
+	switch {
+	case level == offLevel:
+		return "off"
+	case level == onLevel:
+		return "on"
+	case mode == ModeColor:
+		return fmt.Sprintf("hue %d", midimap.ClampHue(level))
+	case mode == ModeColorTemp:
+		mireds := midimap.ClampColorTemp(level)
+		return fmt.Sprintf("%d mireds (%dK)", mireds, 1000000/mireds)
+	default:
+		return fmt.Sprintf("%d%% brightness", level)
+	}
+}
+
+// renderLevel is describeLevel for the console, brightnesses being drawn
+// as a bar.
+func (l *midiListener) renderLevel(mode string, level int) string {
+	if level == offLevel || level == onLevel || mode != ModeBrightness {
+		return l.describeLevel(mode, level)
+	}
+	return brightnessBar(level)
+}
+
+// noteTargets returns the lights a key controls, the calibration that maps
+// it to a level and the mode of the level. With zones, keys outside every
+// zone control nothing.
+func (l *midiListener) noteTargets(key uint8) ([]*hue.Light, *midimap.Calibration, string) {
+	if len(l.zones) == 0 {
+		return l.currentLights(), l.calibration, l.mode()
+	}
+
+	for i := range l.zones {
+		zone := &l.zones[i]
+		if !zone.NoKeys && zone.Range.Contains(key) {
+			return []*hue.Light{&zone.Light}, &midimap.Calibration{LeftKey: zone.Range.Low, RightKey: zone.Range.High}, l.lightMode(&zone.Light)
+		}
+	}
+	return nil, nil, ""
+}
+
+// handle is where every MIDI message ends up, from the devices as from
+// -replay. It only needs a listener from newMIDIListener, whose client can
+// point at any bridge, so synthetic messages such as midi.NoteOn(0, 60,
+// 100) drive it the same way without a keyboard.
+func (l *midiListener) handle(msg midi.Message, timestampms int32) {
+	var channel, key, vel, controller, value, pressure, program uint8
+	var bend int16
+	var absoluteBend uint16
+
+	slog.Debug("🎼 MIDI message", "msg", msg.String())
+
+	// Other instruments may share the device, e.g. a drum pad on channel 10
+	if l.opts.MIDIChannels != nil && msg.GetChannel(&channel) && !l.opts.MIDIChannels[channel] {
+		return
+	}
+
+	// Clock ticks keep coming while nobody plays
+	if l.idle != nil && !msg.Is(midi.RealTimeMsg) {
+		l.idle.Reset(l.opts.IdleTimeout)
+		if l.idling.Swap(false) {
+			slog.Info("⏰ MIDI input again, fading back in")
+			l.fadeIn.Store(true)
+			defer l.fadeIn.Store(false)
+		}
+	}
+
+	if l.dashboard != nil {
+		defer func() { l.dashboard.Update(l.snapshot(msg.String())) }()
+	}
+
+	if l.bindings != nil {
+		l.handleBinding(msg)
+		return
+	}
+
+	switch {
+	// Channel pressure and per-key pressure both modulate the saturation.
+	// Keyboards without aftertouch never get here.
+	case msg.GetAfterTouch(&channel, &pressure) || msg.GetPolyAfterTouch(&channel, &key, &pressure):
+		l.handleAftertouch(pressure)
+
+	case msg.GetPitchBend(&channel, &bend, &absoluteBend):
+		l.handlePitchBend(bend)
+
+	case msg.GetProgramChange(&channel, &program):
+		l.handleProgramChange(program)
+
+	case msg.GetControlChange(&channel, &controller, &value):
+		switch {
+		case int(controller) == l.opts.LatchCC:
+			l.handleLatch(value)
+		case int(controller) == l.opts.TransitionCC:
+			l.handleTransition(controller, value)
+		case int(controller) == l.opts.HueCC || int(controller) == l.opts.SatCC:
+			l.handlePad(controller, value)
+		case l.ccZone(controller) != nil:
+			l.handleZoneCC(l.ccZone(controller), value)
+		case l.useCC && controller == uint8(l.opts.CC):
+			l.handleFader(controller, value)
+		case controller == sustainPedal && l.useNotes:
+			l.handleSustain(value)
+		}
+
+	case !l.useNotes:
+		return
+
+	case msg.GetNoteOn(&channel, &key, &vel) && vel > 0:
+		l.handleNoteOn(key, vel)
+
+	// Some keyboards send Note On with velocity 0 instead of Note Off, so
+	// both are treated as a release.
+	case msg.GetNoteOff(&channel, &key, &vel) || msg.GetNoteOn(&channel, &key, &vel):
+		l.handleNoteOff(key)
+	}
+}
+
+func (l *midiListener) handleNoteOn(key, vel uint8) {
+	midiNotesTotal.Add(1)
+
+	if l.holding() {
+		return
+	}
+	if len(l.opts.Chords) > 0 {
+		l.trackChord(key, true)
+	}
+
+	// The toggle key sits within the keyboard range but never maps to a
+	// level
+	if int(key) == l.opts.ToggleKey {
+		l.toggle()
+		slog.Info(fmt.Sprintf("🔀 Key %d → toggle", key))
+		return
+	}
+	if int(key) == l.opts.UpKey || int(key) == l.opts.DownKey {
+		delta := l.opts.Step
+		if int(key) == l.opts.DownKey {
+			delta = -delta
+		}
+		l.stepBrightness(key, delta)
+		return
+	}
+
+	if scene, ok := l.scenes[key]; ok {
+		l.recallScene(scene)
+		slog.Info(fmt.Sprintf("🎬 Key %d → scene %s", key, scene.Name))
+		return
+	}
+
+	targets, calibration, mode := l.noteTargets(key)
+	if len(targets) == 0 {
+		return
+	}
+
+	now := time.Now()
+	previous := l.lastNote.Swap(now.UnixNano())
+	if l.opts.Strobe > 0 && now.Sub(time.Unix(0, previous)) < l.opts.Strobe {
+		for _, light := range targets {
+			l.send(light, func(ctx context.Context, light *hue.Light) error {
+				return l.client.WithContext(ctx).Alert(light, l.opts.StrobeAlert)
+			})
+		}
+		slog.Info(fmt.Sprintf("⚡ Key %d → flash%s", key, l.zoneSuffix(targets)))
+		return
+	}
+
+	var level int
+	switch mode {
+	case ModeColor:
+		level = midimap.Hue(key, calibration)
+	case ModeColorTemp:
+		level = midimap.ColorTemp(key, calibration)
+	default:
+		if l.opts.PitchClass {
+			calibration = midimap.PitchClass(key, calibration)
+		}
+		level = midimap.NoteBrightness(key, vel, calibration, l.opts.Mapping, l.opts.Curve)
+		if l.opts.Invert {
+			// Before the bounds, so 0% still switches the lights off
+			level = 100 - level
+		}
+	}
+
+	// Each light gets its own aggregate, its held keys and level being its
+	// own
+	type change struct {
+		light *hue.Light
+		level int
+	}
+	var changed []change
+	shown := level
+	l.mu.Lock()
+	for _, light := range targets {
+		state := l.levels[light.Key()]
+		// In momentary mode we remember the level that was active before
+		// the first held key so that releasing it can bring it back.
+		if len(state.held) == 0 {
+			state.restore = state.current
+		}
+		state.press(key, level)
+
+		// A key under a brighter held one doesn't change the light
+		aggregate := state.aggregate(mode, l.opts.ChordMode)
+		if aggregate != state.current || len(state.held) == 1 {
+			state.current = aggregate
+			changed = append(changed, change{light, aggregate})
+		}
+		shown = aggregate
+	}
+	l.mu.Unlock()
+
+	for _, c := range changed {
+		l.applyLevel(c.light, c.level)
+	}
+	slog.Info(fmt.Sprintf("🎹 Key %d (velocity %d) → %s%s", key, vel, l.renderLevel(mode, shown), l.zoneSuffix(targets)))
+}
+
+func (l *midiListener) handleNoteOff(key uint8) {
+	if len(l.opts.Chords) > 0 {
+		l.trackChord(key, false)
+	}
+
+	targets, _, mode := l.noteTargets(key)
+	frozen := l.holding()
+
+	for _, light := range targets {
+		l.mu.Lock()
+		state := l.levels[light.Key()]
+		if !state.release(key) || frozen {
+			l.mu.Unlock()
+			continue
+		}
+
+		// The remaining keys of a chord take over. Once all are released
+		// the light latches, or goes back in momentary mode.
+		level := state.current
+		switch {
+		case len(state.held) > 0:
+			level = state.aggregate(mode, l.opts.ChordMode)
+		case l.opts.Momentary:
+			level = state.restore
+		}
+		// Only the final release of a momentary key always sends, like the
+		// first press does
+		if level == state.current && (len(state.held) > 0 || !l.opts.Momentary) {
+			l.mu.Unlock()
+			continue
+		}
+		state.current = level
+		l.mu.Unlock()
+
+		l.applyLevel(light, level)
+		slog.Info(fmt.Sprintf("🎹 Key %d released → %s%s", key, l.renderLevel(mode, level), l.zoneSuffix([]*hue.Light{light})))
+	}
+}
+
+// stepBrightness moves the brightness of every light by delta percent
+// from its current level, switching it off at 0% and back on above.
+func (l *midiListener) stepBrightness(key uint8, delta int) {
+	// Levels are colors in the other modes, which can't be stepped
+	if l.mode() != ModeBrightness {
+		return
+	}
+
+	for _, light := range l.currentLights() {
+		l.mu.Lock()
+		state := l.levels[light.Key()]
+		level := midimap.ClampBrightness(max(state.current, 0) + delta)
+		if level == 0 {
+			level = offLevel
+		}
+		if level == state.current {
+			l.mu.Unlock()
+			continue
+		}
+		state.current = level
+		l.mu.Unlock()
+
+		l.applyLevel(light, level)
+		slog.Info(fmt.Sprintf("🔆 Key %d (%+d%%) → %s%s", key, delta, l.renderLevel(ModeBrightness, level), l.zoneSuffix([]*hue.Light{light})))
+	}
+}
+
+// handleProgramChange switches to the mode mapped to a program, if any.
+func (l *midiListener) handleProgramChange(program uint8) {
+	mode, ok := l.opts.ProgramModes[program]
+	if !ok || mode == l.mode() {
+		return
+	}
+
+	// Levels mean something else in the new mode, start from scratch
+	l.mu.Lock()
+	l.currentMode.Store(mode)
+	for _, state := range l.levels {
+		state.held = nil
+		state.restore = offLevel
+		state.current = offLevel
+	}
+	l.mu.Unlock()
+
+	slog.Info(fmt.Sprintf("🔀 Program %d → %s mode", program, mode))
+}
+
+// handleSustain freezes the lights at their current level while the pedal
+// is down. Pedals send values in between for half-pedaling, only crossing
+// the middle counts.
+func (l *midiListener) handleSustain(value uint8) {
+	frozen := value >= 64
+	if l.frozen.Swap(frozen) == frozen {
+		return
+	}
+
+	if frozen {
+		slog.Info("🦶 Sustain pedal down, keys are ignored until it is released")
+	} else {
+		slog.Info("🦶 Sustain pedal up, keys control the lights again")
+	}
+}
+
+// handleLatch toggles the latch on each press of the switch. While
+// latched, keys, the fader and the pitch-bend wheel leave the brightness
+// alone, program changes still switch modes.
+func (l *midiListener) handleLatch(value uint8) {
+	down := value >= 64
+	if l.latchDown.Swap(down) == down || !down {
+		return
+	}
+
+	if !l.latched.Load() {
+		l.latched.Store(true)
+		slog.Info("🔒 Latched, the brightness holds until the switch is pressed again")
+	} else {
+		l.latched.Store(false)
+		slog.Info("🔓 Unlatched, playing controls the lights again")
+	}
+}
+
+// holding reports whether the sustain pedal or the latch hold the lights.
+func (l *midiListener) holding() bool {
+	return l.frozen.Load() || l.latched.Load()
+}
+
+// zoneSuffix names the light a key went to when zones are in use.
+func (l *midiListener) zoneSuffix(targets []*hue.Light) string {
+	if len(l.zones) == 0 || len(targets) != 1 {
+		return ""
+	}
+	return " (" + targets[0].Name + ")"
+}
+
+// handleTransition sets the fade time of the brightness changes that
+// follow, the lights themselves don't change.
+func (l *midiListener) handleTransition(controller, value uint8) {
+	transition := midimap.CCTransition(value)
+	if time.Duration(l.transition.Swap(int64(transition))) == transition {
+		return
+	}
+	slog.Info(fmt.Sprintf("🌀 CC%d → fade %s", controller, transition))
+}
+
+// stateOptions returns how brightness changes are applied, with the
+// transition of -fade or -transition-cc.
+func (l *midiListener) stateOptions() hue.StateOptions {
+	return hue.StateOptions{Transition: time.Duration(l.transition.Load())}
+}
+
+func (l *midiListener) handleFader(controller, value uint8) {
+	if l.latched.Load() {
+		return
+	}
+	brightness := midimap.CCBrightness(value)
+	if l.opts.Deadband > 0 && !l.passDeadband(brightness) {
+		return
+	}
+	l.setBrightness(brightness)
+	slog.Info(fmt.Sprintf("🎛️  CC%d %d → %s", controller, value, brightnessBar(brightness)))
+}
+
+// passDeadband reports whether a fader brightness is more than -deadband
+// away from the last one sent, or at either end, so it goes out now.
+// Smaller moves are held back, the latest being sent once the fader
+// rested for deadbandSettle.
+func (l *midiListener) passDeadband(brightness int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.deadbandTimer != nil {
+		l.deadbandTimer.Stop()
+	}
+	if l.faderSent < 0 || brightness == 0 || brightness == 100 || brightness > l.faderSent+l.opts.Deadband || brightness < l.faderSent-l.opts.Deadband {
+		l.faderSent = brightness
+		return true
+	}
+
+	if brightness != l.faderSent {
+		l.deadbandTimer = time.AfterFunc(deadbandSettle, func() {
+			l.mu.Lock()
+			l.faderSent = brightness
+			l.mu.Unlock()
+
+			l.setBrightness(brightness)
+			slog.Info(fmt.Sprintf("🎛️  Fader rested → %s", brightnessBar(brightness)))
+		})
+	}
+	return false
+}
+
+// handlePad changes the hue or the saturation of the color lights, keeping
+// the other. Both go out in a single color update, and moving the pad
+// sends at most one per throttle interval for each light.
+func (l *midiListener) handlePad(controller, value uint8) {
+	var changed bool
+	if int(controller) == l.opts.HueCC {
+		hue := midimap.CCHue(value)
+		changed = int64(hue) != l.padHue.Swap(int64(hue))
+	} else {
+		sat := midimap.CCSaturation(value)
+		changed = int64(sat) != l.padSat.Swap(int64(sat))
+	}
+	if !changed {
+		return
+	}
+
+	// Both axes go in every update, so the queued one carries the latest
+	// position of the pad
+	h, sat := int(l.padHue.Load()), int(l.padSat.Load())
+	for _, light := range l.currentLights() {
+		if light.SupportsColor {
+			l.update(light, hue.ColorUpdate(h, sat))
+		}
+	}
+
+	if l.mode() == ModeColor {
+		l.mu.Lock()
+		for _, state := range l.levels {
+			state.current = h
+		}
+		l.mu.Unlock()
+	}
+	slog.Info(fmt.Sprintf("🎨 CC%d %d → hue %d, saturation %d", controller, value, h, sat))
+}
+
+// setBrightness sends a brightness to every light regardless of the keys,
+// as done by the fader and the HTTP endpoint.
+func (l *midiListener) setBrightness(brightness int) {
+	for _, light := range l.currentLights() {
+		emitEvent("light_changed", "id", light.Key(), "name", light.Name, "mode", ModeBrightness, "level", brightness)
+	}
+	for _, light := range l.currentLights() {
+		l.update(light, hue.BrightnessUpdate(l.bound(brightness), l.stateOptions()))
+	}
+
+	// In the other modes levels are colors, which the fader leaves alone
+	if l.mode() == ModeBrightness {
+		l.mu.Lock()
+		for _, state := range l.levels {
+			state.current = brightness
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *midiListener) handlePitchBend(bend int16) {
+	// The wheel boosts or dims brightness, colors aren't bent
+	if l.opts.BendRange == 0 || l.mode() != ModeBrightness || l.latched.Load() {
+		return
+	}
+
+	offset := midimap.BendOffset(bend, l.opts.BendRange)
+	if int64(offset) == l.bendOffset.Swap(int64(offset)) {
+		return
+	}
+
+	for _, light := range l.currentLights() {
+		l.mu.Lock()
+		level := l.levels[light.Key()].current
+		l.mu.Unlock()
+
+		l.applyLevel(light, level)
+	}
+	slog.Info(fmt.Sprintf("🎚️  Pitch bend %+d%%", offset))
+}
+
+func (l *midiListener) handleAftertouch(pressure uint8) {
+	// Saturation means nothing for white color temperatures
+	if l.mode() == ModeColorTemp {
+		return
+	}
+
+	sat := midimap.PressureSaturation(pressure)
+	if int64(sat) == l.saturation.Swap(int64(sat)) {
+		return
+	}
+
+	// In color mode the hue is known, so resend the whole color.
+	// Otherwise only nudge the saturation of color lights.
+	if l.mode() == ModeColor {
+		for _, light := range l.currentLights() {
+			l.mu.Lock()
+			level := l.levels[light.Key()].current
+			l.mu.Unlock()
+
+			if level != offLevel {
+				l.applyLevel(light, level)
+			}
+		}
+		return
+	}
+
+	for _, light := range l.currentLights() {
+		if light.SupportsColor {
+			l.update(light, hue.SaturationUpdate(sat))
+		}
+	}
+}
+
+// handleExternalChange records a change made to a light from another app,
+// as reported by the event stream.
+func (l *midiListener) handleExternalChange(light *hue.Light, cached hue.CachedLightState) {
+	// Events echoing our own updates arrive shortly after we send them.
+	if time.Since(time.Unix(0, l.lastSent.Load())) < externalChangeGrace {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	mode := l.lightMode(light)
+	state := l.levels[light.Key()]
+	level := state.current
+	switch {
+	case !cached.On:
+		level = offLevel
+	case mode == ModeBrightness && cached.HasBrightness:
+		level = int(math.Round(cached.Brightness))
+	case state.current == offLevel:
+		// Turned on at a level we don't track, but it's no longer off.
+		level = onLevel
+	}
+	if level == state.current {
+		return
+	}
+
+	if mode != ModeBrightness && level != offLevel {
+		slog.Info(fmt.Sprintf("🔔 %s was turned on outside huemidi", light.Name))
+	} else {
+		slog.Info(fmt.Sprintf("🔔 %s changed outside huemidi → %s", light.Name, l.describeLevel(mode, level)))
+	}
+
+	// A held key keeps control; the new level becomes what releasing it
+	// restores.
+	if len(state.held) > 0 {
+		state.restore = level
+	} else {
+		state.current = level
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+
+	"huemidi/hue"
+	"huemidi/midimap"
+)
+
+// request is what a test bridge received.
+type request struct {
+	method string
+	path   string
+	body   string
+}
+
+// testOptions returns the options of a run without flags, except for
+// -throttle 0 so every update is sent before handle returns. They are
+// built here rather than parsed so the HUE_* variables of whoever runs the
+// tests don't change them.
+func testOptions() *Options {
+	return &Options{
+		Mapping:       midimap.MappingKey,
+		ChordMode:     ChordLast,
+		Curve:         midimap.Curve{Shape: midimap.CurveLinear, Gamma: 2.2},
+		Mode:          ModeBrightness,
+		Control:       ControlNotes,
+		CC:            7,
+		HueCC:         -1,
+		SatCC:         -1,
+		LatchCC:       -1,
+		TransitionCC:  -1,
+		MaxBrightness: 100,
+		BendRange:     50,
+		LeftKey:       -1,
+		RightKey:      -1,
+		ToggleKey:     -1,
+		UpKey:         -1,
+		DownKey:       -1,
+		Step:          10,
+		StrobeAlert:   hue.AlertSelect,
+	}
+}
+
+// newTestListener returns a listener driving the lights, Desk with ID 3 if
+// none are given, on a test v1 bridge calibrated from key 48 to 72, and the
+// requests the bridge gets.
+func newTestListener(t *testing.T, opts *Options, lights ...hue.Light) (*midiListener, <-chan request) {
+	t.Helper()
+
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{method: r.Method, path: r.URL.Path, body: string(body)}
+		io.WriteString(w, `[{"success":{}}]`)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	client := hue.NewClient(&hue.Bridge{IP: host, Port: portNumber, Username: "testuser"})
+
+	if len(lights) == 0 {
+		lights = []hue.Light{{ID: "3", Name: "Desk", SupportsDimming: true, Reachable: true}}
+	}
+	l := newMIDIListener(client, nil, lights, nil, nil, midimap.NewCalibration(48, 72), opts)
+	return l, requests
+}
+
+// expectRequest fails unless the bridge got a PUT of body to the state of
+// the test light.
+func expectRequest(t *testing.T, requests <-chan request, body string) {
+	t.Helper()
+
+	select {
+	case got := <-requests:
+		if got.method != "PUT" || got.path != "/api/testuser/lights/3/state" {
+			t.Errorf("sent %s %s, want PUT /api/testuser/lights/3/state", got.method, got.path)
+		}
+		if got.body != body {
+			t.Errorf("sent %s, want %s", got.body, body)
+		}
+	default:
+		t.Errorf("sent nothing, want %s", body)
+	}
+}
+
+// expectNoRequest fails if the bridge got anything.
+func expectNoRequest(t *testing.T, requests <-chan request) {
+	t.Helper()
+
+	select {
+	case got := <-requests:
+		t.Errorf("sent %s %s %s, want nothing", got.method, got.path, got.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandleNoteOn(t *testing.T) {
+	tests := []struct {
+		name string
+		key  uint8
+		want string
+	}{
+		{"left key", 48, `{"on":false}`},
+		{"midpoint", 60, `{"on":true,"bri":127}`},
+		{"right key", 72, `{"on":true,"bri":254}`},
+		{"above right key", 96, `{"on":true,"bri":254}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, requests := newTestListener(t, testOptions())
+
+			l.handle(midi.NoteOn(0, tt.key, 100), 0)
+			expectRequest(t, requests, tt.want)
+		})
+	}
+}
+
+func TestHandleNoteOffLatches(t *testing.T) {
+	l, requests := newTestListener(t, testOptions())
+
+	l.handle(midi.NoteOn(0, 60, 100), 0)
+	expectRequest(t, requests, `{"on":true,"bri":127}`)
+
+	l.handle(midi.NoteOff(0, 60), 0)
+	expectNoRequest(t, requests)
+}
+
+func TestHandleNoteOffMomentary(t *testing.T) {
+	opts := testOptions()
+	opts.Momentary = true
+	l, requests := newTestListener(t, opts)
+
+	l.handle(midi.NoteOn(0, 60, 100), 0)
+	expectRequest(t, requests, `{"on":true,"bri":127}`)
+
+	// The light counted as off before the key, so it goes back off
+	l.handle(midi.NoteOff(0, 60), 0)
+	expectRequest(t, requests, `{"on":false}`)
+}
+
+func TestHandleNoteOffRestoresExternalOn(t *testing.T) {
+	opts := testOptions()
+	opts.Mode = ModeColorTemp
+	opts.Momentary = true
+	l, requests := newTestListener(t, opts)
+	l.lights[0].SupportsColorTemp = true
+
+	// Switched on from another app, at a white we don't know
+	l.handleExternalChange(&l.lights[0], hue.CachedLightState{On: true})
+
+	l.handle(midi.NoteOn(0, 48, 100), 0)
+	expectRequest(t, requests, fmt.Sprintf(`{"on":true,"ct":%d}`, hue.MaxColorTemp))
+
+	l.handle(midi.NoteOff(0, 48), 0)
+	expectRequest(t, requests, `{"on":true}`)
+}
+
+func TestHandleNoteOnAggregatesEachLight(t *testing.T) {
+	opts := testOptions()
+	opts.ChordMode = ChordMax
+	l, requests := newTestListener(t, opts,
+		hue.Light{ID: "3", Name: "Desk", SupportsDimming: true, Reachable: true},
+		hue.Light{ID: "4", Name: "Lamp", SupportsDimming: true, Reachable: true},
+	)
+
+	// Only the desk has the right key held, e.g. from a zone it left
+	desk := l.levels[l.lights[0].Key()]
+	desk.press(72, 100)
+	desk.current = 100
+
+	l.handle(midi.NoteOn(0, 60, 100), 0)
+
+	// The desk stays at its brighter held key, the lamp follows the new one
+	select {
+	case got := <-requests:
+		if got.path != "/api/testuser/lights/4/state" || got.body != `{"on":true,"bri":127}` {
+			t.Errorf("sent %s %s, want %s to light 4", got.path, got.body, `{"on":true,"bri":127}`)
+		}
+	default:
+		t.Fatal("sent nothing, want the lamp at 50%")
+	}
+	expectNoRequest(t, requests)
+}
+
+func TestHandleChordLastKeyWins(t *testing.T) {
+	l, requests := newTestListener(t, testOptions())
+
+	l.handle(midi.NoteOn(0, 72, 100), 0)
+	expectRequest(t, requests, `{"on":true,"bri":254}`)
+
+	// -chord-mode last by default, the dimmer key pressed later wins
+	l.handle(midi.NoteOn(0, 60, 100), 0)
+	expectRequest(t, requests, `{"on":true,"bri":127}`)
+
+	// and releasing it hands back to the key still held
+	l.handle(midi.NoteOff(0, 60), 0)
+	expectRequest(t, requests, `{"on":true,"bri":254}`)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// consoleHandler is a slog.Handler printing records the way huemidi always
+// talked to the terminal: the message as written, followed by its
+// attributes, if any, as key=value pairs.
+type consoleHandler struct {
+	level slog.Leveler
+	w     io.Writer
+	mu    *sync.Mutex
+	attrs []slog.Attr
+}
+
+func newConsoleHandler(w io.Writer, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{level: level, w: w, mu: &sync.Mutex{}}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, record slog.Record) error {
+	var b strings.Builder
+	b.WriteString(record.Message)
+
+	writeAttr := func(attr slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", attr.Key, attr.Value)
+		return true
+	}
+	for _, attr := range h.attrs {
+		writeAttr(attr)
+	}
+	record.Attrs(writeAttr)
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+// WithGroup is a no-op, huemidi doesn't group its attributes.
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// teeHandler passes records to several handlers, each filtering them by
+// its own level.
+type teeHandler []slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, handler := range h {
+		if handler.Enabled(ctx, record.Level) {
+			if err := handler.Handle(ctx, record.Clone()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// events, set with -json, writes the events of emitEvent as JSON lines.
+var events *slog.Logger
+
+// setupLogging installs the console handler as the default logger. Verbose
+// adds the HTTP requests and raw MIDI messages, quiet keeps only warnings
+// and errors.
+//
+// With a jsonOut, significant events and the warnings and errors are also
+// written there as one JSON object per line, see emitEvent.
+func setupLogging(verbose, quiet bool, jsonOut io.Writer) {
+	var handler slog.Handler = newConsoleHandler(os.Stdout, logLevel(verbose, quiet))
+	if jsonOut != nil {
+		handler = teeHandler{handler, slog.NewJSONHandler(jsonOut, &slog.HandlerOptions{Level: slog.LevelWarn})}
+		events = slog.New(slog.NewJSONHandler(jsonOut, &slog.HandlerOptions{
+			// The message is the event name, the level is always INFO
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				switch {
+				case len(groups) > 0:
+				case attr.Key == slog.MessageKey:
+					attr.Key = "event"
+				case attr.Key == slog.LevelKey:
+					return slog.Attr{}
+				}
+				return attr
+			},
+		}))
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// emitEvent writes a significant event with -json, such as the bridge
+// being found or a light changing, with its details as key-value pairs.
+// Without -json the console messages tell the same story and nothing is
+// written.
+func emitEvent(event string, args ...any) {
+	if events != nil {
+		events.Info(event, args...)
+	}
+}
+
+// colorOutput is whether the console output can use ANSI colors.
+var colorOutput bool
+
+// useColor reports whether to color the console output: not with
+// -no-color or NO_COLOR (https://no-color.org), nor when it is piped or
+// redirected to a file.
+func useColor(noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// barWidth is the number of cells of a brightness bar.
+const barWidth = 10
+
+// barColors go from a dim orange to a pale yellow as the brightness goes
+// up, in the 256-color palette.
+var barColors = []int{94, 130, 136, 178, 220, 228}
+
+// brightnessBar renders a 0-100% brightness as a bar followed by the
+// percentage, e.g. "[█████░░░░░] 50%", colored by the value when the
+// console allows it.
+func brightnessBar(brightness int) string {
+	brightness = min(max(brightness, 0), 100)
+	filled := (brightness*barWidth + 50) / 100
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", barWidth-filled)
+	if colorOutput {
+		color := barColors[brightness*(len(barColors)-1)/100]
+		bar = fmt.Sprintf("\x1b[38;5;%dm%s\x1b[0m", color, bar)
+	}
+	return fmt.Sprintf("[%s] %d%%", bar, brightness)
+}
+
+// logLevel is the lowest level logged with -verbose and -quiet.
+func logLevel(verbose, quiet bool) slog.Level {
+	switch {
+	case verbose:
+		return slog.LevelDebug
+	case quiet:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
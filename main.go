@@ -2,193 +2,1853 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"log/slog"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/manifoldco/promptui"
-	"github.com/tidwall/gjson"
 	"gitlab.com/gomidi/midi/v2"
 	"gitlab.com/gomidi/midi/v2/drivers"
 	_ "gitlab.com/gomidi/midi/v2/drivers/rtmididrv" // autoregisters driver
+
+	"huemidi/hue"
+	"huemidi/midimap"
+)
+
+// supportsMode reports whether the light can be driven in the given mode.
+func supportsMode(l hue.Light, mode string) bool {
+	switch mode {
+	case ModeColor:
+		return l.SupportsColor
+	case ModeColorTemp:
+		return l.SupportsColorTemp
+	default:
+		return true
+	}
+}
+
+// Options holds the command-line settings that tune how MIDI input is
+// translated into light changes.
+type Options struct {
+	// Momentary makes a key release restore the brightness that was active
+	// before the key was pressed (or turn the light off). When false the
+	// light latches at the level of the last pressed key.
+	Momentary bool
+	// ToggleCooldown is the shortest time between switching a light on
+	// and off, 0 for none. Switches within it are held back and the
+	// latest one sent once it is over.
+	ToggleCooldown time.Duration
+
+	// Mapping selects how a note is turned into a brightness level, see
+	// the midimap.Mapping* constants.
+	Mapping string
+
+	// ChordMode is how the brightnesses of held keys add up, see the
+	// Chord* constants.
+	ChordMode string
+
+	// Curve shapes the key position before it becomes a brightness.
+	Curve midimap.Curve
+
+	// Invert flips the brightness of notes, the higher keys getting
+	// darker.
+	Invert bool
+	// PitchClass maps notes by their pitch class, each octave going from
+	// 0% at C to 100% at B, instead of across the calibrated range.
+	PitchClass bool
+
+	// Mode selects which light property the keys control, see the Mode*
+	// constants.
+	Mode string
+
+	// Multi lets the user pick several lights that respond together.
+	Multi bool
+
+	// Throttle is the minimum delay between two commands sent to the same
+	// light. Updates arriving faster are coalesced, keeping the latest.
+	Throttle time.Duration
+
+	// Fade is how long lights take to glide to a new brightness. 0 leaves
+	// the bridge's default transition.
+	Fade time.Duration
+
+	// IdleTimeout fades the lights to IdleBrightness percent once no MIDI
+	// message arrived for that long, 0 disables it.
+	IdleTimeout    time.Duration
+	IdleBrightness int
+
+	// Ramp is how long the keys take to move the lights to a new
+	// brightness, sending the brightnesses in between. 0 jumps.
+	Ramp time.Duration
+
+	// MIDIDevice selects the MIDI input by index or name, skipping the
+	// interactive prompt.
+	MIDIDevice string
+
+	// MIDIChannels are the channels listened to, numbered 1-16 as on the
+	// devices but stored 0-15 as in the messages. Empty means all.
+	MIDIChannels map[uint8]bool
+
+	// MIDIDevices listens to several MIDI inputs at once, by index or
+	// name, or to every input with "all". The first one is calibrated.
+	MIDIDevices []string
+
+	// BridgeIP skips discovery and connects to this bridge directly.
+	BridgeIP string
+
+	// DiscoveryURL is the cloud endpoint listing the bridges on our
+	// network.
+	DiscoveryURL string
+
+	// MDNSTimeout is how long to wait for bridges to answer over mDNS.
+	MDNSTimeout time.Duration
+
+	// NoRestore leaves the lights as they were last played instead of
+	// restoring their original state on exit.
+	NoRestore bool
+
+	// API forces the Hue API version (v1 or v2) instead of detecting it.
+	API string
+
+	// InsecureTLS accepts any certificate from the bridge on the v2 API,
+	// instead of only one issued to its ID.
+	InsecureTLS bool
+
+	// Events follows the bridge's v2 event stream to notice changes made to
+	// the lights from other apps.
+	Events bool
+
+	// Control selects which MIDI messages drive the light, see the
+	// Control* constants.
+	Control string
+
+	// CC is the Control Change number mapped to brightness.
+	CC int
+	// Deadband is how many percent the fader has to move before its new
+	// brightness is sent right away, 0 sending every change.
+	Deadband int
+
+	// HueCC and SatCC are the Control Change numbers mapped to the hue
+	// and saturation of color lights, such as the two axes of an XY pad.
+	// -1 when unset.
+	HueCC int
+	SatCC int
+
+	// LatchCC is the Control Change of a foot switch holding the
+	// brightness until pressed again, -1 when unset.
+	LatchCC int
+
+	// TransitionCC is the Control Change setting the transition time of
+	// brightness changes instead of -fade, such as the mod wheel (1). -1
+	// when unset.
+	TransitionCC int
+
+	// MinBrightness and MaxBrightness are the percentages that 0% and
+	// 100% are mapped to.
+	MinBrightness int
+	MaxBrightness int
+
+	// BendRange is how many brightness percent the pitch-bend wheel adds
+	// or removes at its extremes. 0 ignores the wheel.
+	BendRange int
+
+	// Recalibrate ignores the saved calibration.
+	Recalibrate bool
+
+	// Calibration is how the keyboard range is learned, see the
+	// Calibration* constants.
+	Calibration string
+
+	// Username, LightID, LeftKey and RightKey skip the matching interactive
+	// step, so that huemidi can run without a terminal. LeftKey and
+	// RightKey are -1 when unset.
+	Username string
+	LightID  string
+	// LightName selects the light whose name contains it, ignoring case.
+	LightName string
+	// LightIndex selects a light by its 1-based position in -list-lights,
+	// 0 when unset.
+	LightIndex int
+	// LightTypes narrows the lights offered to those of these kinds or
+	// Hue types, see matchesLightType.
+	LightTypes []string
+	LeftKey    int
+	RightKey   int
+
+	// Zones gives every selected light its own range of keys, see the
+	// Zones* constants. Empty means all lights follow the whole keyboard.
+	Zones string
+
+	// ZoneOctave is the octave of the first light in ZonesOctave mode.
+	ZoneOctave int
+
+	// Targets, loaded from a targets file, give each light its own keys,
+	// controller and mode, and pick the lights.
+	Targets []Target
+
+	// Scenes binds notes to the name or ID of the scene they recall.
+	Scenes map[uint8]string
+
+	// Chords map the pitch classes of a chord to what playing it does.
+	Chords map[pitchSet]*ChordAction
+
+	// NoGroupBatch keeps a call per light even when the selected lights
+	// make up a whole room or zone.
+	NoGroupBatch bool
+
+	// ToggleKey is a note switching the lights on or off, -1 for none.
+	ToggleKey int
+
+	// UpKey and DownKey are notes stepping the brightness up or down by
+	// Step percent from wherever it is, -1 for none.
+	UpKey   int
+	DownKey int
+	Step    int
+
+	// Bindings, loaded from a bindings file, say what each message does
+	// instead of the keyboard being mapped across its range.
+	Bindings []Binding
+
+	// ProgramModes maps MIDI program numbers to the Mode* constant that a
+	// program change switches to.
+	ProgramModes map[uint8]string
+
+	// Strobe is the gap under which repeated notes flash the lights with
+	// StrobeAlert, see the hue.Alert* constants, instead of changing them. 0
+	// disables it.
+	Strobe      time.Duration
+	StrobeAlert string
+
+	// MetricsAddr, when set, is where Prometheus metrics are served.
+	MetricsAddr string
+
+	// HTTPAddr, when set, is where the HTTP control endpoint listens.
+	HTTPAddr string
+
+	// OSCAddr, when set, is where OSC messages are received over UDP.
+	OSCAddr string
+
+	// Record, when set, is the file the MIDI messages of the session are
+	// recorded to.
+	Record string
+	// Replay, when set, holds the messages of a recording played back
+	// instead of listening to MIDI devices.
+	Replay []recordedMessage
+
+	// Verbose also logs HTTP requests and raw MIDI messages, Quiet only
+	// warnings and errors.
+	Verbose bool
+	Quiet   bool
+
+	// NoColor keeps ANSI colors out of the console output, which is also
+	// the case when it isn't a terminal or NO_COLOR is set.
+	NoColor bool
+
+	// TUI replaces the scrolling log with a dashboard of the lights while
+	// listening.
+	TUI bool
+
+	// Doctor checks the setup step by step and exits.
+	Doctor bool
+
+	// Setup, from huemidi setup, goes through discovery, pairing, light
+	// selection and calibration, saves it all and exits.
+	Setup bool
+	// SavedLights are the keys of the lights saved by setup, used when
+	// none are given on the command line.
+	SavedLights []string
+
+	// ListLights prints the lights and exits, as JSON with JSON. Otherwise
+	// JSON writes the events of the session as JSON lines, see emitEvent.
+	ListLights bool
+	JSON       bool
+
+	// Stream names the entertainment area the lights are streamed to,
+	// instead of updating them with REST calls.
+	Stream string
+
+	// DryRun prints the light updates instead of sending them.
+	DryRun bool
+
+	// Test flashes the lights picked in the selection prompt so the user
+	// can check they are the right ones.
+	Test bool
+
+	// ResetConfig wipes the saved config file before starting.
+	ResetConfig bool
+
+	// Profile names the part of the config file in use, defaultProfile
+	// unless several setups are kept.
+	Profile string
+
+	// CredentialStore is where the bridge username is saved, see the
+	// Store* constants.
+	CredentialStore string
+}
+
+// Supported values for Options.Control.
+const (
+	// ControlNotes uses piano keys only.
+	ControlNotes = "notes"
+	// ControlCC uses a fader or knob sending Control Change messages.
+	ControlCC = "cc"
+	// ControlBoth uses keys and the fader/knob together.
+	ControlBoth = "both"
+)
+
+// Supported values for Options.ChordMode.
+const (
+	// ChordMax lets the brightest held key win.
+	ChordMax = "max"
+	// ChordMin lets the dimmest held key win.
+	ChordMin = "min"
+	// ChordAverage averages the held keys.
+	ChordAverage = "average"
+	// ChordLast lets the last key pressed win.
+	ChordLast = "last"
+)
+
+// Supported values for Options.Calibration.
+const (
+	// CalibrationEnds asks for the key at each end of the keyboard.
+	CalibrationEnds = "ends"
+	// CalibrationSweep records the lowest and highest keys of a
+	// glissando across the whole keyboard.
+	CalibrationSweep = "sweep"
+)
+
+// sweepWindow is how long a sweep calibration listens after its first note.
+const sweepWindow = 5 * time.Second
+
+// Supported values for Options.Zones.
+const (
+	// ZonesOctave maps one octave to each light.
+	ZonesOctave = "octave"
+	// ZonesKeys lets the user play the lowest and highest key for each
+	// light.
+	ZonesKeys = "keys"
+)
+
+// Supported values for Options.Mode.
+const (
+	// ModeBrightness maps keys to brightness.
+	ModeBrightness = "brightness"
+	// ModeColor sweeps keys through the color wheel.
+	ModeColor = "color"
+	// ModeColorTemp maps keys to white color temperature, warm to cool.
+	ModeColorTemp = "ct"
+)
+
+// parseMIDIChannels parses a list of channels such as "1,10", numbered 1-16
+// as shown by MIDI devices.
+func parseMIDIChannels(value string) (map[uint8]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	channels := make(map[uint8]bool)
+	for _, field := range strings.Split(value, ",") {
+		channel, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || channel < 1 || channel > 16 {
+			return nil, fmt.Errorf("channel %q should be between 1 and 16", field)
+		}
+		channels[uint8(channel-1)] = true
+	}
+	return channels, nil
+}
+
+// parseProgramModes parses a list of program=mode pairs such as
+// "0=brightness,1=color".
+func parseProgramModes(value string) (map[uint8]string, error) {
+	modes := make(map[uint8]string)
+	if value == "" {
+		return modes, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		program, mode, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected program=mode, got %q", pair)
+		}
+		number, err := strconv.Atoi(program)
+		if err != nil || number < 0 || number > 127 {
+			return nil, fmt.Errorf("program %q should be a number between 0 and 127", program)
+		}
+		switch mode {
+		case ModeBrightness, ModeColor, ModeColorTemp:
+		default:
+			return nil, fmt.Errorf("unknown mode %q for program %d", mode, number)
+		}
+		modes[uint8(number)] = mode
+	}
+
+	return modes, nil
+}
+
+// envFlags are the environment variables standing in for flags, for
+// setups where passing arguments is awkward such as containers.
+// HUE_USERNAME is handled with the other credentials, see
+// authenticateWithBridge.
+var envFlags = []struct{ env, flag string }{
+	{"HUE_BRIDGE_IP", "bridge-ip"},
+	{"HUE_DISCOVERY_URL", "discovery-url"},
+	{"HUE_API", "api"},
+	{"HUE_LIGHT_ID", "light-id"},
+	{"HUE_LIGHT_NAME", "light-name"},
+	{"HUE_LIGHT_INDEX", "light-index"},
+	{"HUE_LIGHT_TYPE", "light-type"},
+	{"HUE_PROFILE", "profile"},
+	{"HUE_MODE", "mode"},
+	{"HUE_MIDI_DEVICE", "midi-device"},
+	{"HUE_MIDI_CHANNEL", "midi-channel"},
+	{"HUE_CREDENTIAL_STORE", "credential-store"},
+}
+
+// flagGiven reports whether a flag was set, on the command line or from
+// the environment.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
+
+// applyEnvFlags sets the flags of envFlags from the environment, unless
+// they were given on the command line.
+func applyEnvFlags() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, e := range envFlags {
+		value := os.Getenv(e.env)
+		if value == "" || explicit[e.flag] {
+			continue
+		}
+		if err := flag.Set(e.flag, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", e.env, value, err)
+		}
+	}
+	return nil
+}
+
+func parseFlags() (*Options, error) {
+	opts := &Options{}
+
+	// setup is the only subcommand, the flags follow it
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		opts.Setup = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	flag.BoolVar(&opts.Momentary, "momentary", false, "restore the previous brightness when a key is released")
+	flag.DurationVar(&opts.ToggleCooldown, "toggle-cooldown", 0, "shortest time between switching a light on and off, e.g. 300ms so trills don't flicker it (0 disables)")
+	flag.StringVar(&opts.Mapping, "mapping", midimap.MappingKey, "brightness mapping: key, velocity or key+velocity")
+	flag.StringVar(&opts.Curve.Shape, "curve", midimap.CurveLinear, "brightness curve across the keys: linear, log, exp or gamma")
+	flag.Float64Var(&opts.Curve.Gamma, "gamma", 2.2, "exponent of -curve gamma, above 1 gives finer steps on the low keys")
+	flag.BoolVar(&opts.PitchClass, "pitch-class", false, "map the brightness by the note within its octave, C to B, whatever the octave")
+	flag.BoolVar(&opts.Invert, "invert", false, "flip the brightness of notes so the lights get darker as you play higher")
+	flag.StringVar(&opts.Mode, "mode", ModeBrightness, "what the keys control: brightness, color or ct (color temperature)")
+	flag.BoolVar(&opts.Multi, "multi", false, "select several lights to control together")
+	flag.DurationVar(&opts.Throttle, "throttle", 100*time.Millisecond, "minimum delay between commands to the same light (0 disables)")
+	flag.DurationVar(&opts.Ramp, "ramp", 0, "glide to the brightness of a new key over this long, sending the steps in between (0 disables)")
+	flag.DurationVar(&opts.IdleTimeout, "idle-timeout", 0, "fade the lights to -idle-brightness after this long without MIDI input, e.g. 10m (0 disables)")
+	flag.IntVar(&opts.IdleBrightness, "idle-brightness", 0, "brightness percent the lights fade to after -idle-timeout, 0 switches them off")
+	flag.DurationVar(&opts.Fade, "fade", 0, "brightness transition time, in steps of 100ms (0 uses the bridge default)")
+	flag.StringVar(&opts.MIDIDevice, "midi-device", "", "MIDI input device to use, by index or name")
+	midiChannels := flag.String("midi-channel", "", "only act on messages from these MIDI channels, 1-16 (comma-separated for several, empty for all)")
+	midiDevices := flag.String("midi-devices", "", "MIDI input devices to use together, by index or name (comma-separated), or all")
+	flag.StringVar(&opts.BridgeIP, "bridge-ip", "", "IP address of the Hue bridge, skips discovery")
+	flag.StringVar(&opts.DiscoveryURL, "discovery-url", hue.DefaultDiscoveryURL, "Hue discovery endpoint listing the bridges on the network")
+	flag.DurationVar(&opts.MDNSTimeout, "mdns-timeout", 3*time.Second, "how long to wait for bridges to answer local mDNS discovery")
+	flag.BoolVar(&opts.NoRestore, "no-restore", false, "leave the lights as last played instead of restoring them on exit")
+	flag.StringVar(&opts.API, "api", hue.APIAuto, "Hue API to use: auto, v1 or v2")
+	flag.BoolVar(&opts.InsecureTLS, "insecure-tls", false, "accept any HTTPS certificate from the bridge on the v2 API, not only one issued to its ID; anyone able to answer at the bridge's IP could then get the username")
+	flag.BoolVar(&opts.Events, "events", false, "follow changes made from other apps via the v2 event stream")
+	flag.StringVar(&opts.ChordMode, "chord-mode", ChordLast, "how the brightnesses of held keys add up: last, max, min or average")
+	flag.StringVar(&opts.Control, "control", ControlNotes, "MIDI messages that drive the light: notes, cc or both")
+	flag.IntVar(&opts.CC, "cc", 7, "Control Change number mapped to brightness (1 = mod wheel, 7 = volume)")
+	flag.IntVar(&opts.Deadband, "deadband", 0, "brightness percent the -cc fader has to move before a change is sent, e.g. 2 for a noisy fader (0 sends every change)")
+	flag.IntVar(&opts.HueCC, "hue-cc", -1, "Control Change number mapped to the hue of color lights, e.g. the X axis of an XY pad")
+	flag.IntVar(&opts.SatCC, "sat-cc", -1, "Control Change number mapped to the saturation of color lights, e.g. the Y axis of an XY pad")
+	flag.IntVar(&opts.LatchCC, "latch-cc", -1, "Control Change number of a foot switch that holds the brightness until pressed again")
+	flag.IntVar(&opts.TransitionCC, "transition-cc", -1, "Control Change number setting how fast the brightness fades, from 100ms to 5s (1 = mod wheel)")
+	flag.IntVar(&opts.MinBrightness, "min-brightness", 0, "brightness percent of the lowest key, above 0 the lights never turn off")
+	flag.IntVar(&opts.MaxBrightness, "max-brightness", 100, "brightness percent of the highest key")
+	flag.IntVar(&opts.BendRange, "bend-range", 50, "brightness percent added or removed by the pitch-bend wheel at its extremes (0 ignores it)")
+	flag.BoolVar(&opts.Recalibrate, "recalibrate", false, "calibrate the keyboard again instead of using the saved calibration")
+	flag.StringVar(&opts.Calibration, "calibration", CalibrationEnds, "how to calibrate the keyboard: ends (press both end keys) or sweep (play across the whole keyboard)")
+	flag.StringVar(&opts.CredentialStore, "credential-store", StoreAuto, "where to save the bridge username: auto, keyring or config")
+	flag.StringVar(&opts.Username, "username", "", "Hue bridge username, skips authentication")
+	flag.StringVar(&opts.LightID, "light-id", "", "ID of the light to control (comma-separated for several), skips selection")
+	lightTypes := flag.String("light-type", "", "only offer lights of these kinds (color, white ambiance, dimmable, on/off, room, zone) or Hue types, comma-separated")
+	flag.StringVar(&opts.LightName, "light-name", "", "name of the light to control (case-insensitive, part of the name is enough), skips selection")
+	flag.IntVar(&opts.LightIndex, "light-index", 0, "number of the light to control as shown by -list-lights, skips selection")
+	flag.IntVar(&opts.LeftKey, "left-key", -1, "MIDI note of the 0% key, skips calibration together with -right-key (may be the higher key to reverse the keyboard)")
+	flag.IntVar(&opts.RightKey, "right-key", -1, "MIDI note of the 100% key, skips calibration together with -left-key")
+	flag.StringVar(&opts.Zones, "zones", "", "give each selected light its own keys: octave or keys")
+	flag.IntVar(&opts.ZoneOctave, "zone-octave", 4, "octave of the first light with -zones octave (C4 = note 60)")
+	flag.StringVar(&opts.Stream, "stream", "", "entertainment area to stream the lights to over DTLS, by name or ID, for lower latency (v2 API only)")
+	flag.BoolVar(&opts.NoGroupBatch, "no-group-batch", false, "update the selected lights one by one even when they make up a whole room or zone")
+	flag.IntVar(&opts.ToggleKey, "toggle-key", -1, "MIDI note that switches the lights on or off instead of setting a brightness")
+	flag.IntVar(&opts.UpKey, "up-key", -1, "MIDI note that raises the brightness by -step instead of setting it")
+	flag.IntVar(&opts.DownKey, "down-key", -1, "MIDI note that lowers the brightness by -step instead of setting it")
+	flag.IntVar(&opts.Step, "step", 10, "brightness percentage added or removed by each press of -up-key or -down-key")
+	flag.StringVar(&opts.Record, "record", "", "record the incoming MIDI messages to this file, to play them back later with -replay")
+	replayFile := flag.String("replay", "", "play back a file recorded with -record with its original timing, instead of listening to a MIDI device")
+	targets := flag.String("targets", "", "JSON file giving each light its own keys, controller and mode")
+	bindings := flag.String("bindings", "", "JSON file binding notes, CCs and program changes to actions, replacing the keyboard mapping")
+	scenes := flag.String("scenes", "", "notes that recall a scene instead of changing the light, as note=scene pairs, e.g. 60=Relax,62=Concentrate")
+	chords := flag.String("chords", "", "chords that set a color or recall a scene once held, as chord=action pairs, e.g. C=ct:2700,Am=hue:46000,F=Relax")
+	programModes := flag.String("program-modes", "0=brightness,1=color,2=ct", "program changes that switch modes, as program=mode pairs (empty disables)")
+	flag.DurationVar(&opts.Strobe, "strobe", 0, "flash the lights when notes are played faster than this, e.g. 150ms (0 disables)")
+	flag.StringVar(&opts.StrobeAlert, "strobe-alert", hue.AlertSelect, "flash used by -strobe: select (once) or lselect (continuous)")
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9090")
+	flag.StringVar(&opts.HTTPAddr, "http-addr", "", "also accept brightness changes over HTTP on this address, e.g. :8080")
+	flag.StringVar(&opts.OSCAddr, "osc-addr", "", "also accept OSC messages over UDP on this address, e.g. :8000 for TouchOSC")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "also log HTTP requests and raw MIDI messages")
+	flag.BoolVar(&opts.Verbose, "v", false, "shorthand for -verbose")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "only log warnings and errors, not every key press")
+	flag.BoolVar(&opts.Quiet, "q", false, "shorthand for -quiet")
+	flag.BoolVar(&opts.NoColor, "no-color", false, "don't color the brightness bars printed for key presses")
+	flag.BoolVar(&opts.Doctor, "doctor", false, "check discovery, the bridge, the username, the lights and the MIDI devices, then exit")
+	flag.BoolVar(&opts.ListLights, "list-lights", false, "print the lights of the bridge and exit")
+	flag.BoolVar(&opts.JSON, "json", false, "print -list-lights output as JSON, or else the events of the session as JSON lines on stdout")
+	flag.BoolVar(&opts.TUI, "tui", false, "show a live dashboard of the lights instead of logging every key")
+	flag.BoolVar(&opts.Test, "test", false, "flash the selected lights once to check they are the right ones")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "print the requests that would change the lights instead of sending them")
+	flag.BoolVar(&opts.ResetConfig, "reset-config", false, "delete the saved bridge and username before starting")
+	flag.StringVar(&opts.Profile, "profile", defaultProfile, "named profile of the config file to use, e.g. home or studio, each with its own bridge, lights and calibration")
+	flag.Parse()
+	if err := applyEnvFlags(); err != nil {
+		return nil, err
+	}
+
+	if opts.Verbose && opts.Quiet {
+		return nil, errors.New("-verbose and -quiet can't be used together")
+	}
+	if strings.TrimSpace(opts.Profile) == "" {
+		return nil, errors.New("invalid -profile: expected a name, e.g. home")
+	}
+	if opts.Setup {
+		if opts.ListLights || opts.Doctor || opts.Stream != "" || opts.Zones != "" || *replayFile != "" || opts.Record != "" {
+			return nil, errors.New("setup can't be combined with -list-lights, -doctor, -stream, -zones, -replay or -record")
+		}
+		// The whole flow runs again, including the calibration
+		opts.Recalibrate = true
+	}
+
+	switch opts.Mapping {
+	case midimap.MappingKey, midimap.MappingVelocity, midimap.MappingKeyVelocity:
+	default:
+		return nil, fmt.Errorf("invalid -mapping %q: expected %s, %s or %s", opts.Mapping, midimap.MappingKey, midimap.MappingVelocity, midimap.MappingKeyVelocity)
+	}
+
+	switch opts.Curve.Shape {
+	case midimap.CurveLinear, midimap.CurveLog, midimap.CurveExp, midimap.CurveGamma:
+	default:
+		return nil, fmt.Errorf("invalid -curve %q: expected %s, %s, %s or %s", opts.Curve.Shape, midimap.CurveLinear, midimap.CurveLog, midimap.CurveExp, midimap.CurveGamma)
+	}
+	if opts.Curve.Gamma <= 0 {
+		return nil, fmt.Errorf("invalid -gamma %g: expected a positive number", opts.Curve.Gamma)
+	}
+
+	switch opts.API {
+	case hue.APIAuto, hue.APIV1, hue.APIV2:
+	default:
+		return nil, fmt.Errorf("invalid -api %q: expected %s, %s or %s", opts.API, hue.APIAuto, hue.APIV1, hue.APIV2)
+	}
+
+	switch opts.Control {
+	case ControlNotes, ControlCC, ControlBoth:
+	default:
+		return nil, fmt.Errorf("invalid -control %q: expected %s, %s or %s", opts.Control, ControlNotes, ControlCC, ControlBoth)
+	}
+	switch opts.ChordMode {
+	case ChordMax, ChordMin, ChordAverage, ChordLast:
+	default:
+		return nil, fmt.Errorf("invalid -chord-mode %q: expected %s, %s, %s or %s", opts.ChordMode, ChordMax, ChordMin, ChordAverage, ChordLast)
+	}
+
+	if opts.CC < 0 || opts.CC > 127 {
+		return nil, fmt.Errorf("invalid -cc %d: expected 0-127", opts.CC)
+	}
+	if opts.Deadband < 0 || opts.Deadband > 50 {
+		return nil, fmt.Errorf("invalid -deadband %d: expected 0-50", opts.Deadband)
+	}
+	for _, cc := range []struct {
+		name  string
+		value int
+	}{{"-hue-cc", opts.HueCC}, {"-sat-cc", opts.SatCC}, {"-latch-cc", opts.LatchCC}, {"-transition-cc", opts.TransitionCC}} {
+		if cc.value < -1 || cc.value > 127 {
+			return nil, fmt.Errorf("invalid %s %d: expected 0-127", cc.name, cc.value)
+		}
+		if cc.value >= 0 && cc.value == opts.CC && opts.Control != ControlNotes {
+			return nil, fmt.Errorf("invalid %s %d: already mapped to brightness by -cc", cc.name, cc.value)
+		}
+	}
+	if opts.HueCC >= 0 && opts.HueCC == opts.SatCC {
+		return nil, errors.New("-hue-cc and -sat-cc should be different Control Changes")
+	}
+	if opts.LatchCC >= 0 && (opts.LatchCC == opts.HueCC || opts.LatchCC == opts.SatCC) {
+		return nil, fmt.Errorf("invalid -latch-cc %d: already mapped to a color by -hue-cc or -sat-cc", opts.LatchCC)
+	}
+	if opts.TransitionCC >= 0 && (opts.TransitionCC == opts.HueCC || opts.TransitionCC == opts.SatCC || opts.TransitionCC == opts.LatchCC) {
+		return nil, fmt.Errorf("invalid -transition-cc %d: already mapped by -hue-cc, -sat-cc or -latch-cc", opts.TransitionCC)
+	}
+
+	if u, err := url.Parse(opts.DiscoveryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -discovery-url %q: expected an http:// or https:// URL", opts.DiscoveryURL)
+	}
+
+	if *midiDevices != "" {
+		if opts.MIDIDevice != "" {
+			return nil, errors.New("-midi-device and -midi-devices can't be used together")
+		}
+		for _, device := range strings.Split(*midiDevices, ",") {
+			if device = strings.TrimSpace(device); device != "" {
+				opts.MIDIDevices = append(opts.MIDIDevices, device)
+			}
+		}
+	}
+
+	if opts.LightID != "" && opts.LightName != "" {
+		return nil, errors.New("-light-id and -light-name can't be used together")
+	}
+	if opts.LightIndex < 0 {
+		return nil, fmt.Errorf("invalid -light-index %d: expected a light number from -list-lights, starting at 1", opts.LightIndex)
+	}
+	if opts.LightIndex > 0 && (opts.LightID != "" || opts.LightName != "") {
+		return nil, errors.New("-light-index can't be used with -light-id or -light-name")
+	}
+
+	if (opts.LeftKey >= 0) != (opts.RightKey >= 0) {
+		return nil, errors.New("-left-key and -right-key must be given together")
+	}
+	if opts.LeftKey > 127 || opts.RightKey > 127 {
+		return nil, errors.New("-left-key and -right-key must be MIDI notes (0-127)")
+	}
+	if opts.LeftKey >= 0 && opts.LeftKey == opts.RightKey {
+		return nil, fmt.Errorf("-left-key and -right-key should be different keys (both are %d)", opts.LeftKey)
+	}
+
+	switch opts.CredentialStore {
+	case StoreAuto, StoreKeyring, StoreConfig:
+	default:
+		return nil, fmt.Errorf("invalid -credential-store %q: expected %s, %s or %s", opts.CredentialStore, StoreAuto, StoreKeyring, StoreConfig)
+	}
+
+	switch opts.Calibration {
+	case CalibrationEnds, CalibrationSweep:
+	default:
+		return nil, fmt.Errorf("invalid -calibration %q: expected %s or %s", opts.Calibration, CalibrationEnds, CalibrationSweep)
+	}
+
+	switch opts.Zones {
+	case "", ZonesOctave, ZonesKeys:
+	default:
+		return nil, fmt.Errorf("invalid -zones %q: expected %s or %s", opts.Zones, ZonesOctave, ZonesKeys)
+	}
+
+	var err error
+	opts.Scenes, err = parseSceneBindings(*scenes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -scenes %q: %v", *scenes, err)
+	}
+	opts.Chords, err = parseChordBindings(*chords)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -chords %q: %v", *chords, err)
+	}
+
+	if opts.ToggleKey < -1 || opts.ToggleKey > 127 {
+		return nil, fmt.Errorf("invalid -toggle-key %d: expected a MIDI note (0-127)", opts.ToggleKey)
+	}
+	if _, ok := opts.Scenes[uint8(opts.ToggleKey)]; ok && opts.ToggleKey >= 0 {
+		return nil, fmt.Errorf("key %d can't be both -toggle-key and a scene", opts.ToggleKey)
+	}
+	for name, key := range map[string]int{"up-key": opts.UpKey, "down-key": opts.DownKey} {
+		if key < -1 || key > 127 {
+			return nil, fmt.Errorf("invalid -%s %d: expected a MIDI note (0-127)", name, key)
+		}
+		if _, ok := opts.Scenes[uint8(key)]; ok && key >= 0 {
+			return nil, fmt.Errorf("key %d can't be both -%s and a scene", key, name)
+		}
+		if key >= 0 && key == opts.ToggleKey {
+			return nil, fmt.Errorf("key %d can't be both -%s and -toggle-key", key, name)
+		}
+	}
+	if opts.UpKey >= 0 && opts.UpKey == opts.DownKey {
+		return nil, errors.New("-up-key and -down-key must be different keys")
+	}
+	if opts.Step < 1 || opts.Step > 100 {
+		return nil, fmt.Errorf("invalid -step %d: expected a percentage (1-100)", opts.Step)
+	}
+
+	for _, lightType := range strings.Split(*lightTypes, ",") {
+		if lightType = strings.TrimSpace(lightType); lightType != "" {
+			opts.LightTypes = append(opts.LightTypes, lightType)
+		}
+	}
+
+	opts.MIDIChannels, err = parseMIDIChannels(*midiChannels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -midi-channel %q: %v", *midiChannels, err)
+	}
+
+	if *replayFile != "" {
+		if opts.Record != "" {
+			return nil, errors.New("-record and -replay can't be combined")
+		}
+		if opts.Zones != "" {
+			return nil, errors.New("-zones maps the keys with the keyboard, it can't be combined with -replay")
+		}
+		opts.Replay, err = loadRecording(*replayFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -replay %q: %v", *replayFile, err)
+		}
+	}
+
+	if *bindings != "" {
+		if opts.Zones != "" || len(opts.Scenes) > 0 {
+			return nil, errors.New("-bindings can't be combined with -zones or -scenes, bind the keys in the file instead")
+		}
+		opts.Bindings, err = loadBindings(*bindings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -bindings %q: %v", *bindings, err)
+		}
+	}
+
+	if *targets != "" {
+		if opts.Zones != "" || *bindings != "" {
+			return nil, errors.New("-targets can't be combined with -zones or -bindings")
+		}
+		if lightsGiven(opts) {
+			return nil, errors.New("-targets names the lights, it can't be combined with -light-id, -light-name or -light-index")
+		}
+		opts.Targets, err = loadTargets(*targets)
+		if err == nil {
+			err = checkTargetConflicts(opts.Targets, opts)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid -targets %q: %v", *targets, err)
+		}
+	}
+
+	opts.ProgramModes, err = parseProgramModes(*programModes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -program-modes %q: %v", *programModes, err)
+	}
+
+	if opts.Strobe < 0 {
+		return nil, fmt.Errorf("invalid -strobe %s: expected a positive duration", opts.Strobe)
+	}
+	switch opts.StrobeAlert {
+	case hue.AlertSelect, hue.AlertLSelect:
+	default:
+		return nil, fmt.Errorf("invalid -strobe-alert %q: expected %s or %s", opts.StrobeAlert, hue.AlertSelect, hue.AlertLSelect)
+	}
+
+	if opts.Fade < 0 || opts.Fade > hue.MaxTransition {
+		return nil, fmt.Errorf("invalid -fade %s: expected 0-%s", opts.Fade, hue.MaxTransition)
+	}
+	if opts.IdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid -idle-timeout %s: expected a positive duration", opts.IdleTimeout)
+	}
+	if opts.IdleBrightness < 0 || opts.IdleBrightness > 100 {
+		return nil, fmt.Errorf("invalid -idle-brightness %d: expected 0-100", opts.IdleBrightness)
+	}
+	if opts.Ramp < 0 {
+		return nil, fmt.Errorf("invalid -ramp %s: expected a positive duration", opts.Ramp)
+	}
+	if opts.ToggleCooldown < 0 {
+		return nil, fmt.Errorf("invalid -toggle-cooldown %s: expected a positive duration", opts.ToggleCooldown)
+	}
+
+	if opts.MinBrightness < 0 || opts.MaxBrightness > 100 || opts.MinBrightness >= opts.MaxBrightness {
+		return nil, fmt.Errorf("invalid -min-brightness %d and -max-brightness %d: expected 0 <= min < max <= 100", opts.MinBrightness, opts.MaxBrightness)
+	}
+
+	if opts.BendRange < 0 || opts.BendRange > 100 {
+		return nil, fmt.Errorf("invalid -bend-range %d: expected 0-100", opts.BendRange)
+	}
+
+	switch opts.Mode {
+	case ModeBrightness, ModeColor, ModeColorTemp:
+	default:
+		return nil, fmt.Errorf("invalid -mode %q: expected %s, %s or %s", opts.Mode, ModeBrightness, ModeColor, ModeColorTemp)
+	}
+
+	return opts, nil
+}
+
+func main() {
+	opts, err := parseFlags()
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	// run returns once everything it set up has been undone, error or not
+	if err := run(opts); err != nil {
+		// Ctrl+C in a prompt, status 130 as for SIGINT
+		if errors.Is(err, errPromptCanceled) {
+			fmt.Println("\n👋 Canceled")
+			os.Exit(130)
+		}
+		emitEvent("error", "error", err.Error())
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run is a whole huemidi session: it connects to the bridge, picks the
+// lights and the MIDI device, and controls the lights until asked to stop.
+func run(opts *Options) error {
+
+	// Keep stdout for the JSON document or events, everything else goes to
+	// stderr
+	stdout := os.Stdout
+	var jsonOut io.Writer
+	if opts.JSON {
+		os.Stdout = os.Stderr
+		if !opts.ListLights {
+			jsonOut = stdout
+		}
+	}
+	setupLogging(opts.Verbose, opts.Quiet, jsonOut)
+	colorOutput = useColor(opts.NoColor)
+
+	fmt.Println("🎹 HueMIDI - Control your Hue lights with MIDI!")
+	fmt.Println("==========================================")
+
+	if opts.Profile != defaultProfile {
+		fmt.Printf("📁 Using profile %s\n", opts.Profile)
+	}
+	if opts.ResetConfig {
+		if err := resetConfig(opts.Profile); err != nil {
+			return fmt.Errorf("failed to reset config: %v", err)
+		}
+		clearKeyring(opts.Profile)
+		fmt.Println("🗑️  Config reset")
+	}
+
+	cfg, err := loadConfig(opts.Profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	if opts.Doctor {
+		return runDoctor(cfg, opts)
+	}
+
+	// What setup saved applies unless given on the command line
+	if !opts.Setup {
+		if cfg.Mode != "" && !flagGiven("mode") {
+			opts.Mode = cfg.Mode
+		}
+		if len(cfg.Lights) > 0 && !lightsGiven(opts) {
+			opts.SavedLights = cfg.Lights
+		}
+	}
+
+	// Discover Hue bridge, unless the user told us where it is
+	var bridge *hue.Bridge
+	if opts.BridgeIP != "" {
+		if err := hue.CheckBridge(opts.BridgeIP); err != nil {
+			return fmt.Errorf("failed to connect to Hue bridge: %v", err)
+		}
+		bridge = &hue.Bridge{IP: opts.BridgeIP}
+	} else {
+		bridge, err = discoverHueBridge(cfg, opts)
+		if err != nil {
+			return fmt.Errorf("failed to discover Hue bridge: %w", err)
+		}
+	}
+
+	bridge.InsecureTLS = opts.InsecureTLS
+	fmt.Printf("✅ Found Hue bridge at: %s\n", bridge.IP)
+
+	// Show which bridge this is, and ask bridges not found through
+	// discovery for their ID
+	if config, err := hue.FetchPublicConfig(bridge.Addr()); err != nil {
+		slog.Debug("Failed to get the public bridge config", "err", err)
+	} else {
+		if bridge.ID == "" {
+			bridge.ID = config.BridgeID
+		}
+		bridge.APIVersion = config.APIVersion
+		printBridgeConfig(config)
+	}
+
+	if err := hue.ChooseAPI(bridge, opts.API); err != nil {
+		return fmt.Errorf("failed to select Hue API: %v", err)
+	}
+	if bridge.UseV2 {
+		fmt.Println("✨ Using Hue API v2")
+	}
+	emitEvent("bridge_found", "ip", bridge.IP, "id", bridge.ID, "api_version", bridge.APIVersion, "v2", bridge.UseV2)
+
+	store, err := newCredentialStore(opts.CredentialStore, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open credential store: %v", err)
+	}
+
+	// Authenticate with bridge, unless given a username
+	if opts.Username != "" {
+		bridge.Username = opts.Username
+	} else {
+		err = authenticateWithBridge(bridge, cfg, store)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with bridge: %w", err)
+		}
+	}
+	emitEvent("authenticated", "bridge_id", bridge.ID)
+
+	// Get available lights
+	client := hue.NewClient(bridge)
+	client.Metrics = bridgeMetrics{}
+	if opts.DryRun {
+		client.DryRun = true
+		fmt.Println("🧪 Dry run: light updates are printed, not sent")
+	}
+
+	fmt.Println("💡 Getting available lights...")
+	lights, err := client.Lights()
+	if hue.IsBridgeError(err, hue.ErrTypeUnauthorized) && opts.Username == "" {
+		// The username can be revoked between checking and using it
+		slog.Warn("⚠️  The bridge rejected our username, pairing again")
+		if err := pairWithBridge(bridge, cfg, store); err != nil {
+			return fmt.Errorf("failed to authenticate with bridge: %v", err)
+		}
+		client.Username = bridge.Username
+		lights, err = client.Lights()
+	}
+	if hue.IsBridgeError(err, hue.ErrTypeUnauthorized) {
+		return fmt.Errorf("the bridge rejected the username, check -username or run without it to pair again")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get lights: %v", err)
+	}
+
+	if opts.ListLights {
+		if err := printLights(stdout, lights, opts.JSON); err != nil {
+			return fmt.Errorf("failed to print lights: %v", err)
+		}
+		return nil
+	}
+
+	selectedLights, targets, err := selectTargets(client, lights, opts, nil)
+	if err != nil {
+		return err
+	}
+
+	// Lights given on the command line are known already, nobody may be
+	// watching them when running headless
+	if opts.Test && !lightsGiven(opts) {
+		flashLights(client, selectedLights)
+	}
+
+	// SIGHUP fetches the lights again, e.g. after adding a bulb
+	refresh := func() ([]hue.Light, error) {
+		fmt.Println("🔄 Refreshing the lights...")
+		lights, err := client.RefreshLights()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get lights: %v", err)
+		}
+		selected, targets, err := selectTargets(client, lights, opts, selectedLights)
+		if err != nil {
+			return nil, err
+		}
+		selectedLights = selected
+		return targets, nil
+	}
+
+	// Look up the scenes bound to notes
+	var sceneBindings map[uint8]hue.Scene
+	if len(opts.Scenes) > 0 || bindsScenes(opts.Bindings) || chordsScenes(opts.Chords) {
+		scenes, err := client.Scenes()
+		if err != nil {
+			return fmt.Errorf("failed to get scenes: %v", err)
+		}
+		sceneBindings, err = resolveScenes(scenes, opts.Scenes)
+		if err != nil {
+			return fmt.Errorf("failed to bind scenes: %v", err)
+		}
+		if err := resolveBindingScenes(scenes, opts.Bindings); err != nil {
+			return fmt.Errorf("failed to bind scenes: %v", err)
+		}
+		if err := resolveChordScenes(scenes, opts.Chords); err != nil {
+			return fmt.Errorf("failed to bind scenes: %v", err)
+		}
+	}
+
+	// Snapshot the lights so the session can be undone on exit, even if
+	// something fails from now on
+	if !opts.NoRestore {
+		savedStates := captureLightStates(client, selectedLights)
+		defer restoreLightStates(client, selectedLights, savedStates)
+	}
+
+	var stream *hue.Stream
+	if opts.Stream != "" {
+		stream, err = startStream(client, bridge, selectedLights, opts.Stream)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := stream.Close(); err != nil {
+				slog.Warn(fmt.Sprintf("⚠️  %v", err))
+			}
+		}()
+	}
+
+	defer midi.CloseDriver()
+
+	// A saved calibration is reused unless asked otherwise or invalid
+	saved := cfg.Calibration
+	if saved != nil && (opts.Recalibrate || saved.LeftKey >= saved.RightKey) {
+		saved = nil
+	}
+
+	// Pick the MIDI input device, preferring the calibrated one
+	device := opts.MIDIDevice
+	if device == "" && saved != nil && midiPortExists(saved.Device) {
+		device = saved.Device
+	}
+
+	var ins []drivers.In
+	switch {
+	case opts.Replay != nil:
+		// The recording stands in for the devices
+		fmt.Printf("📼 Replaying %d recorded MIDI messages, no MIDI device needed\n", len(opts.Replay))
+	case len(opts.MIDIDevices) > 0:
+		ins, err = selectMIDIDevices(opts.MIDIDevices)
+	default:
+		var in drivers.In
+		in, err = selectMIDIDevice(device)
+		ins = []drivers.In{in}
+	}
+	if err != nil && opts.OSCAddr != "" && len(midi.GetInPorts()) == 0 {
+		fmt.Println("🎛️  No MIDI device found, only OSC will control the lights")
+		ins, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to select MIDI device: %w", err)
+	}
+
+	for _, in := range ins {
+		fmt.Printf("✅ Using MIDI device: %s\n", in.String())
+		emitEvent("midi_device", "name", in.String())
+	}
+
+	// Keys are learned on the first device, the others usually being
+	// fader boxes
+	var in drivers.In
+	if len(ins) > 0 {
+		in = ins[0]
+	}
+
+	// Ctrl+C while waiting for a key ends the run, with the usual cleanup
+	keyCtx, stopKeyCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopKeyCtx()
+
+	// Map key ranges to lights, or calibrate the whole keyboard unless
+	// only a fader/knob is used or the bindings say what each key does
+	var calibration *midimap.Calibration
+	var zones []LightZone
+	if in == nil && opts.Replay == nil {
+		// Only OSC drives the lights, there are no keys to map
+	} else if len(opts.Bindings) > 0 {
+		fmt.Printf("📁 Using %d bindings, the keyboard isn't calibrated\n", len(opts.Bindings))
+	} else if len(opts.Targets) > 0 {
+		zones, err = targetZones(selectedLights, opts.Targets, opts)
+		if err != nil {
+			return fmt.Errorf("failed to set up -targets: %v", err)
+		}
+	} else if opts.Zones != "" {
+		zones, err = buildZones(keyCtx, in, selectedLights, opts)
+		if errors.Is(err, errKeyCanceled) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to map keys to lights: %v", err)
+		}
+	} else if opts.Control != ControlCC {
+		if opts.LeftKey >= 0 {
+			calibration = midimap.NewCalibration(uint8(opts.LeftKey), uint8(opts.RightKey))
+			zeroKey, fullKey := calibration.Ends()
+			emitEvent("calibrated", "zero_key", zeroKey, "full_key", fullKey, "source", "flags")
+			warnCoarseCalibration(calibration, opts)
+		} else if saved != nil && (in == nil || saved.Device == in.String()) {
+			// A replay uses the keyboard calibrated last
+			calibration = &midimap.Calibration{LeftKey: saved.LeftKey, RightKey: saved.RightKey, Reversed: saved.Reversed}
+			zeroKey, fullKey := calibration.Ends()
+			fmt.Printf("📁 Using saved calibration: 0%% key %d, 100%% key %d (pass -recalibrate to redo it)\n", zeroKey, fullKey)
+			emitEvent("calibrated", "zero_key", zeroKey, "full_key", fullKey, "source", "saved")
+		} else if in == nil {
+			return fmt.Errorf("replaying notes needs the keyboard calibration: run once with the keyboard to calibrate it, or give -left-key and -right-key")
+		} else {
+			calibration, err = calibrateMIDIKeyboard(keyCtx, in, opts.Calibration)
+			if errors.Is(err, errKeyCanceled) {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("failed to calibrate MIDI keyboard: %v", err)
+			}
+
+			zeroKey, fullKey := calibration.Ends()
+			fmt.Printf("✅ MIDI keyboard calibrated: 0%% key %d, 100%% key %d\n", zeroKey, fullKey)
+			emitEvent("calibrated", "zero_key", zeroKey, "full_key", fullKey, "source", "keyboard")
+			warnCoarseCalibration(calibration, opts)
+
+			cfg.Calibration = &CalibrationConfig{
+				Device:   in.String(),
+				LeftKey:  calibration.LeftKey,
+				RightKey: calibration.RightKey,
+				Reversed: calibration.Reversed,
+			}
+			if err := saveConfig(cfg); err != nil {
+				slog.Warn(fmt.Sprintf("⚠️  %v", err))
+			}
+		}
+	}
+	stopKeyCtx()
+
+	if opts.Setup {
+		return saveSetup(cfg, selectedLights, opts)
+	}
+
+	if opts.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	// Start MIDI listener
+	if err := startMIDIListener(client, stream, targets, zones, sceneBindings, ins, calibration, opts, refresh); err != nil {
+		return fmt.Errorf("failed to start MIDI listener: %v", err)
+	}
+
+	return nil
+}
+
+func discoverHueBridge(cfg *Config, opts *Options) (*hue.Bridge, error) {
+	// Prefer the bridge saved from a previous run
+	if cfg.IP != "" {
+		saved := &hue.Bridge{IP: cfg.IP, ID: cfg.BridgeID, Port: cfg.Port}
+		if hue.BridgeReachable(saved.Addr()) {
+			fmt.Println("📁 Using saved Hue bridge")
+			return saved, nil
+		}
+		slog.Warn(fmt.Sprintf("⚠️  Saved bridge at %s is not reachable, falling back to discovery", cfg.IP))
+	}
+
+	fmt.Println("🔍 Discovering Hue bridge...")
+
+	// Try the official discovery endpoint first
+	bridges, cloudErr := hue.DiscoverCloud(opts.DiscoveryURL)
+	if cloudErr != nil || len(bridges) == 0 {
+		if cloudErr != nil {
+			slog.Warn(fmt.Sprintf("⚠️  Cloud discovery failed: %v", cloudErr))
+		}
+
+		// Fall back to the local network, which also works offline
+		fmt.Println("📡 Looking for Hue bridges on the local network (mDNS)...")
+		ips, mdnsErr := hue.DiscoverMDNS(opts.MDNSTimeout)
+		if mdnsErr != nil {
+			return nil, fmt.Errorf("mDNS discovery failed: %v", mdnsErr)
+		}
+		for _, ip := range ips {
+			bridges = append(bridges, hue.Bridge{IP: ip})
+		}
+	}
+
+	if len(bridges) == 0 {
+		if cloudErr != nil {
+			return nil, fmt.Errorf("no Hue bridges found: %v", cloudErr)
+		}
+		return nil, fmt.Errorf("no Hue bridges found")
+	}
+
+	// Stale cloud records and hotspot addresses show up too
+	bridges, err := reachableBridges(bridges)
+	if err != nil {
+		return nil, err
+	}
+
+	// The saved bridge may just have been given a new IP
+	if cfg.BridgeID != "" {
+		for i := range bridges {
+			if strings.EqualFold(bridges[i].ID, cfg.BridgeID) {
+				fmt.Printf("📁 Saved bridge %s moved to %s\n", cfg.BridgeID, bridges[i].IP)
+				return &bridges[i], nil
+			}
+		}
+	}
+
+	// Only ask when there is an actual choice to make
+	if len(bridges) == 1 {
+		return &bridges[0], nil
+	}
+
+	return selectBridge(bridges)
+}
+
+// reachableBridges keeps the discovered bridges that answer, in order,
+// failing with every address tried when none does.
+func reachableBridges(bridges []hue.Bridge) ([]hue.Bridge, error) {
+	var reachable []hue.Bridge
+	var tried []string
+	var lastErr error
+	for _, bridge := range bridges {
+		if err := hue.CheckBridge(bridge.Addr()); err != nil {
+			slog.Debug("Skipping unreachable bridge", "ip", bridge.IP, "err", err)
+			tried = append(tried, bridge.Addr())
+			lastErr = err
+			continue
+		}
+		reachable = append(reachable, bridge)
+	}
+
+	if len(reachable) == 0 {
+		return nil, fmt.Errorf("none of the Hue bridges found is reachable, tried %s: %v", strings.Join(tried, ", "), lastErr)
+	}
+	if len(tried) > 0 {
+		slog.Warn(fmt.Sprintf("⚠️  Ignoring unreachable bridges at %s", strings.Join(tried, ", ")))
+	}
+	return reachable, nil
+}
+
+// printBridgeConfig prints what the bridge tells about itself, leaving out
+// what older bridges don't.
+func printBridgeConfig(config *hue.PublicConfig) {
+	var details []string
+	if config.Name != "" {
+		details = append(details, config.Name)
+	}
+	if model := config.Model(); model != "" {
+		details = append(details, model)
+	}
+	if config.APIVersion != "" {
+		details = append(details, "API "+config.APIVersion)
+	}
+	if config.SWVersion != "" {
+		details = append(details, "firmware "+config.SWVersion)
+	}
+	if len(details) > 0 {
+		fmt.Printf("   %s\n", strings.Join(details, ", "))
+	}
+}
+
+// errPromptCanceled is returned by the prompts given up on with Ctrl+C or
+// Ctrl+D, for main to exit like an interrupted program.
+var errPromptCanceled = errors.New("canceled")
+
+// promptError turns the errors promptui returns when a prompt is given up
+// on into errPromptCanceled.
+func promptError(err error) error {
+	if errors.Is(err, promptui.ErrInterrupt) || errors.Is(err, promptui.ErrEOF) || errors.Is(err, promptui.ErrAbort) {
+		return errPromptCanceled
+	}
+	return err
+}
+
+func selectBridge(bridges []hue.Bridge) (*hue.Bridge, error) {
+	items := make([]string, len(bridges))
+	for i := range bridges {
+		items[i] = bridges[i].IP
+		if name := hue.BridgeName(bridges[i].Addr()); name != "" {
+			items[i] = fmt.Sprintf("%s (%s)", name, bridges[i].IP)
+		}
+	}
+
+	prompt := promptui.Select{
+		Label: "Several Hue bridges found, select one",
+		Items: items,
+		Templates: &promptui.SelectTemplates{
+			Label:    "{{ . }}?",
+			Active:   "▶ {{ . | cyan }}",
+			Inactive: "  {{ . | white }}",
+			Selected: "✅ {{ . | green }}",
+		},
+	}
+
+	i, _, err := prompt.Run()
+	if err != nil {
+		return nil, promptError(err)
+	}
+
+	return &bridges[i], nil
+}
+
+func authenticateWithBridge(bridge *hue.Bridge, cfg *Config, store CredentialStore) error {
+	fmt.Println("🔐 Authenticating with Hue bridge...")
+
+	// The keyring comes first, then HUE_USERNAME, then the config file
+	if _, ok := store.(keyringStore); ok {
+		creds, err := store.Load()
+		if err != nil {
+			slog.Warn(fmt.Sprintf("⚠️  Failed to read the keyring: %v", err))
+		}
+		if creds.Username != "" {
+			if hue.UsernameValid(bridge, creds.Username) {
+				bridge.Username = creds.Username
+				bridge.ClientKey = creds.ClientKey
+				rememberBridge(cfg, bridge)
+				return nil
+			}
+			slog.Warn("⚠️  The username in the keyring was rejected by the bridge")
+		}
+	}
+
+	if username := os.Getenv("HUE_USERNAME"); username != "" {
+		err := checkEnvUsername(bridge, username)
+		if err == nil {
+			bridge.Username = username
+			return nil
+		}
+		slog.Error(fmt.Sprintf("❌ The username in HUE_USERNAME was rejected: %v", err))
+		pair, err := offerPairing()
+		if err != nil {
+			return err
+		}
+		if !pair {
+			return fmt.Errorf("HUE_USERNAME was rejected, fix or unset it")
+		}
+	}
+
+	if cfg.Username != "" {
+		if hue.UsernameValid(bridge, cfg.Username) {
+			bridge.Username = cfg.Username
+			bridge.ClientKey = cfg.ClientKey
+			rememberBridge(cfg, bridge)
+			return nil
+		}
+		slog.Warn("⚠️  Saved username was rejected by the bridge, pairing again")
+	}
+
+	return pairWithBridge(bridge, cfg, store)
+}
+
+// checkEnvUsername makes sure username, as set in HUE_USERNAME, looks like
+// a bridge username and is accepted by the bridge, before a typo shows up
+// as some later request failing.
+func checkEnvUsername(bridge *hue.Bridge, username string) error {
+	if !hue.ValidUsernameFormat(username) {
+		return fmt.Errorf("it is %d characters long, bridge usernames are 40 letters, digits or dashes", len(username))
+	}
+	if err := hue.CheckUsername(bridge, username); err != nil {
+		if hue.IsBridgeError(err, hue.ErrTypeUnauthorized) {
+			return fmt.Errorf("the bridge doesn't know it, was it paired with another bridge?")
+		}
+		return err
+	}
+	return nil
+}
+
+// offerPairing asks whether to pair again after a rejected username.
+// Without a terminal to ask on, pairing goes ahead as the link button is
+// all it needs.
+func offerPairing() (bool, error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		slog.Warn("⚠️  Pairing again")
+		return true, nil
+	}
+
+	prompt := promptui.Select{
+		Label: "Pair again with the link button",
+		Items: []string{"Yes", "No, exit"},
+	}
+	i, _, err := prompt.Run()
+	if err != nil {
+		return false, promptError(err)
+	}
+	return i == 0, nil
+}
+
+// rememberBridge saves the bridge IP, which may have changed since the last
+// run.
+func rememberBridge(cfg *Config, bridge *hue.Bridge) {
+	if cfg.IP != bridge.IP || cfg.BridgeID != bridge.ID || cfg.Port != bridge.Port {
+		cfg.IP, cfg.BridgeID, cfg.Port = bridge.IP, bridge.ID, bridge.Port
+		if err := saveConfig(cfg); err != nil {
+			slog.Warn(fmt.Sprintf("⚠️  %v", err))
+		}
+	}
+}
+
+const (
+	// linkButtonTimeout is how long pairing waits for the link button.
+	linkButtonTimeout = 30 * time.Second
+	// linkButtonPoll is the delay between two pairing attempts.
+	linkButtonPoll = 2 * time.Second
 )
 
-type HueBridge struct {
-	IP       string
-	Username string
-}
+// pairWithBridge creates a new username with the link button and saves it
+// to store.
+func pairWithBridge(bridge *hue.Bridge, cfg *Config, store CredentialStore) error {
+	fmt.Println("👆 Please press the link button on your Hue bridge")
+
+	// The bridge refuses to pair until the button is pressed, keep asking
+	// until it is or we run out of time
+	deadline := time.Now().Add(linkButtonTimeout)
+	var username, clientKey string
+	for {
+		var err error
+		username, clientKey, err = hue.CreateUser(bridge, "huemidi#cli")
+		if err == nil {
+			fmt.Println()
+			break
+		}
+		if !hue.IsBridgeError(err, hue.ErrTypeLinkButtonNotPressed) {
+			fmt.Println()
+			var bridgeErr *hue.BridgeError
+			if errors.As(err, &bridgeErr) {
+				return fmt.Errorf("authentication failed: %s", bridgeErr.Description)
+			}
+			return fmt.Errorf("failed to authenticate: %v", err)
+		}
+
+		left := time.Until(deadline).Round(time.Second)
+		if left <= 0 {
+			fmt.Println()
+			return fmt.Errorf("link button wasn't pressed within %s", linkButtonTimeout)
+		}
+		fmt.Printf("\r⏳ Waiting for the link button... %2ds left ", int(left.Seconds()))
+		time.Sleep(linkButtonPoll)
+	}
+
+	bridge.Username = username
+	bridge.ClientKey = clientKey
+	fmt.Printf("✅ Authenticated! Username: %s\n", bridge.Username)
+
+	cfg.IP, cfg.BridgeID, cfg.Port = bridge.IP, bridge.ID, bridge.Port
+	if _, ok := store.(*configStore); !ok {
+		// The username lives in the keyring, don't leave an old copy in
+		// the config file
+		cfg.Username, cfg.ClientKey = "", ""
+		if err := saveConfig(cfg); err != nil {
+			slog.Warn(fmt.Sprintf("⚠️  %v", err))
+		}
+	}
+
+	// Bridges paired over v1 hand out no client key, an old one belongs
+	// to the previous username and is dropped
+	creds := Credentials{Username: bridge.Username, ClientKey: bridge.ClientKey}
+	if err := store.Save(creds); err != nil {
+		slog.Warn(fmt.Sprintf("⚠️  %v", err))
+		fmt.Printf("💡 Set HUE_USERNAME=%s to skip this step next time\n", bridge.Username)
+	} else {
+		fmt.Printf("💾 Saved bridge and username to %s, this step will be skipped next time\n", store.Name())
+	}
 
-type Light struct {
-	ID   string
-	Name string
+	return nil
 }
 
-type MIDICalibration struct {
-	LeftKey  uint8
-	RightKey uint8
+// lightInfo is a light in the -list-lights -json output.
+type lightInfo struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Kind      string `json:"kind"`
+	Reachable bool   `json:"reachable"`
 }
 
-func main() {
-	fmt.Println("🎹 HueMIDI - Control your Hue lights with MIDI!")
-	fmt.Println("==========================================")
+// printLights writes the inventory of lights, one per line or as a JSON
+// array, numbered from 1 as -light-index expects.
+func printLights(w io.Writer, lights []hue.Light, asJSON bool) error {
+	if asJSON {
+		infos := make([]lightInfo, 0, len(lights))
+		for i, light := range lights {
+			infos = append(infos, lightInfo{Index: i + 1, ID: light.ID, Name: light.Name, Type: light.Type, Kind: light.Kind(), Reachable: light.Reachable})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
 
-	// Discover Hue bridge
-	bridge, err := discoverHueBridge()
-	if err != nil {
-		log.Fatal("Failed to discover Hue bridge:", err)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tID\tNAME\tTYPE\tREACHABLE")
+	for i, light := range lights {
+		reachable := "yes"
+		if !light.Reachable {
+			reachable = "no"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, light.ID, light.Name, light.Type, reachable)
 	}
+	return tw.Flush()
+}
 
-	fmt.Printf("✅ Found Hue bridge at: %s\n", bridge.IP)
+// startStream starts streaming to the entertainment area named by area,
+// which has to contain every selected light.
+func startStream(client *hue.Client, bridge *hue.Bridge, lights []hue.Light, area string) (*hue.Stream, error) {
+	if !client.UseV2 {
+		return nil, fmt.Errorf("-stream needs the Hue API v2")
+	}
+	if bridge.ClientKey == "" {
+		return nil, fmt.Errorf("-stream needs the client key handed out when pairing over v2, run with -reset-config to pair again")
+	}
+	if client.DryRun {
+		return nil, fmt.Errorf("-stream can't be used with -dry-run")
+	}
 
-	// Authenticate with bridge
-	err = authenticateWithBridge(bridge)
+	areas, err := client.EntertainmentAreas()
 	if err != nil {
-		log.Fatal("Failed to authenticate with bridge:", err)
+		return nil, err
+	}
+	var found *hue.EntertainmentArea
+	for i := range areas {
+		if areas[i].ID == area || strings.EqualFold(areas[i].Name, area) {
+			found = &areas[i]
+			break
+		}
+	}
+	if found == nil {
+		names := make([]string, len(areas))
+		for i := range areas {
+			names[i] = areas[i].Name
+		}
+		return nil, fmt.Errorf("no entertainment area named %q, set one up in the Hue app (found: %s)", area, strings.Join(names, ", "))
 	}
 
-	// Get available lights
-	lights, err := getLights(bridge)
-	if err != nil {
-		log.Fatal("Failed to get lights:", err)
+	for _, light := range lights {
+		if _, ok := found.Channels[light.ID]; !ok {
+			return nil, fmt.Errorf("%s is not in entertainment area %s", light.Name, found.Name)
+		}
 	}
 
-	// Let user select a light
-	selectedLight, err := selectLight(lights)
+	stream, err := client.StartStream(*found, bridge.ClientKey)
 	if err != nil {
-		log.Fatal("Failed to select light:", err)
+		return nil, err
 	}
+	fmt.Printf("📡 Streaming to entertainment area %s\n", found.Name)
+	return stream, nil
+}
 
-	fmt.Printf("✅ Selected light: %s\n", selectedLight.Name)
-
-	// Calibrate MIDI keyboard
-	calibration, err := calibrateMIDIKeyboard()
-	if err != nil {
-		log.Fatal("Failed to calibrate MIDI keyboard:", err)
+// flashLights makes each light flash once, leaving it as it was.
+func flashLights(client *hue.Client, lights []hue.Light) {
+	fmt.Println("💡 Flashing the selected lights...")
+	for i := range lights {
+		if err := client.Alert(&lights[i], hue.AlertSelect); err != nil {
+			slog.Warn(fmt.Sprintf("⚠️  Failed to flash %s: %v", lights[i].Name, err))
+		}
 	}
+}
 
-	fmt.Printf("✅ MIDI keyboard calibrated: Left key %d, Right key %d\n", calibration.LeftKey, calibration.RightKey)
+// batchGroup returns the group target made of exactly the selected lights,
+// if there is one. A group with other lights too would change them as well.
+func batchGroup(groups []hue.Light, selected []hue.Light) *hue.Light {
+	if len(selected) < 2 {
+		return nil
+	}
+	ids := make(map[string]bool)
+	for _, light := range selected {
+		if light.Group {
+			return nil
+		}
+		ids[light.ID] = true
+	}
 
-	// Start MIDI listener
-	err = startMIDIListener(bridge, selectedLight, calibration)
-	if err != nil {
-		log.Fatal("Failed to start MIDI listener:", err)
+	for i := range groups {
+		if groups[i].Group && sameLights(groups[i].LightIDs, ids) {
+			return &groups[i]
+		}
 	}
+	return nil
 }
 
-func discoverHueBridge() (*HueBridge, error) {
-	fmt.Println("🔍 Discovering Hue bridge...")
-
-	// Try the official discovery endpoint
-	resp, err := http.Get("https://discovery.meethue.com/")
-	if err != nil {
-		return nil, fmt.Errorf("failed to discover bridge: %v", err)
+// sameLights reports whether lightIDs lists the lights in ids and no other.
+func sameLights(lightIDs []string, ids map[string]bool) bool {
+	seen := make(map[string]bool)
+	for _, id := range lightIDs {
+		if !ids[id] {
+			return false
+		}
+		seen[id] = true
 	}
-	defer resp.Body.Close()
+	return len(seen) == len(ids)
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read discovery response: %v", err)
+// groupTargets turns groups into targets that can be selected like lights,
+// able to do what any of their lights can.
+func groupTargets(groups []hue.Group, lights []hue.Light) []hue.Light {
+	byID := make(map[string]hue.Light)
+	for _, light := range lights {
+		byID[light.ID] = light
 	}
 
-	// Parse JSON response
-	bridges := gjson.GetBytes(body, "#.internalipaddress")
-	if !bridges.Exists() || len(bridges.Array()) == 0 {
-		return nil, fmt.Errorf("no Hue bridges found")
+	var targets []hue.Light
+	for _, group := range groups {
+		target := hue.Light{ID: group.ID, Name: group.Name, Type: group.Type, Group: true, LightIDs: group.LightIDs}
+		for _, id := range group.LightIDs {
+			light, ok := byID[id]
+			if !ok {
+				continue
+			}
+			target.SupportsColor = target.SupportsColor || light.SupportsColor
+			target.SupportsColorTemp = target.SupportsColorTemp || light.SupportsColorTemp
+			target.SupportsDimming = target.SupportsDimming || light.SupportsDimming
+			target.Reachable = target.Reachable || light.Reachable
+		}
+		if len(group.LightIDs) > 0 {
+			targets = append(targets, target)
+		}
 	}
+	return targets
+}
 
-	// Use the first bridge found
-	bridgeIP := bridges.Array()[0].String()
+// lightsForMode returns the lights that can be driven in the given mode.
+func lightsForMode(lights []hue.Light, mode string) []hue.Light {
+	var result []hue.Light
+	for _, light := range lights {
+		if supportsMode(light, mode) {
+			result = append(result, light)
+		}
+	}
+	return result
+}
 
-	return &HueBridge{IP: bridgeIP}, nil
+// lightsOfType returns the lights matching any of the -light-type values.
+func lightsOfType(lights []hue.Light, types []string) []hue.Light {
+	var result []hue.Light
+	for _, light := range lights {
+		for _, lightType := range types {
+			if matchesLightType(light, lightType) {
+				result = append(result, light)
+				break
+			}
+		}
+	}
+	return result
 }
 
-func authenticateWithBridge(bridge *HueBridge) error {
-	fmt.Println("🔐 Authenticating with Hue bridge...")
+// matchesLightType reports whether a light is of a kind, as shown in the
+// list ("color", "dimmable"...), or has it in its Hue type, e.g.
+// "extended color" for "Extended color light", ignoring case. Kinds are
+// the same on both APIs, v2 giving archetypes such as "sultan_bulb" as
+// types.
+func matchesLightType(light hue.Light, lightType string) bool {
+	return strings.EqualFold(light.Kind(), lightType) || strings.Contains(strings.ToLower(light.Type), strings.ToLower(lightType))
+}
 
-	// Check if we already have a username stored
-	if username := os.Getenv("HUE_USERNAME"); username != "" {
-		bridge.Username = username
-		return nil
+// lightKinds lists the kinds of lights there are, for error messages.
+func lightKinds(lights []hue.Light) string {
+	seen := make(map[string]bool)
+	var kinds []string
+	for _, light := range lights {
+		if kind := light.Kind(); !seen[kind] {
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
 	}
+	return strings.Join(kinds, ", ")
+}
 
-	fmt.Println("Please press the link button on your Hue bridge, then press Enter...")
-	reader := bufio.NewReader(os.Stdin)
-	reader.ReadLine()
-
-	// Request username
-	requestBody := `{"devicetype":"huemidi#cli"}`
-	url := fmt.Sprintf("http://%s/api", bridge.IP)
+// lightsGiven reports whether the lights to control are given on the
+// command line rather than picked in a prompt.
+func lightsGiven(opts *Options) bool {
+	return opts.LightID != "" || opts.LightName != "" || opts.LightIndex > 0 || len(opts.Targets) > 0
+}
 
-	resp, err := http.Post(url, "application/json", strings.NewReader(requestBody))
-	if err != nil {
-		return fmt.Errorf("failed to authenticate: %v", err)
+// saveSetup saves the lights and mode picked by huemidi setup, the bridge
+// and calibration being saved already.
+func saveSetup(cfg *Config, selected []hue.Light, opts *Options) error {
+	cfg.Lights = make([]string, len(selected))
+	for i, light := range selected {
+		cfg.Lights[i] = light.Key()
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read auth response: %v", err)
+	cfg.Mode = opts.Mode
+	if err := saveConfig(cfg); err != nil {
+		return err
 	}
 
-	// Parse response
-	username := gjson.GetBytes(body, "0.success.username")
-	if !username.Exists() {
-		errorMsg := gjson.GetBytes(body, "0.error.description")
-		return fmt.Errorf("authentication failed: %s", errorMsg.String())
+	path, _ := configPath()
+	if opts.Profile != defaultProfile {
+		fmt.Printf("🎉 Setup saved to profile %s of %s, run huemidi -profile %s to start playing\n", opts.Profile, path, opts.Profile)
+		return nil
 	}
-
-	bridge.Username = username.String()
-	fmt.Printf("✅ Authenticated! Username: %s\n", bridge.Username)
-	fmt.Printf("💡 Set HUE_USERNAME=%s to skip this step next time\n", bridge.Username)
-
+	fmt.Printf("🎉 Setup saved to %s, run huemidi without arguments to start playing\n", path)
 	return nil
 }
 
-func getLights(bridge *HueBridge) ([]Light, error) {
-	fmt.Println("💡 Getting available lights...")
+// lightsByKey returns the lights saved by setup that are still on the
+// bridge, in the saved order.
+func lightsByKey(lights []hue.Light, keys []string) []hue.Light {
+	var result []hue.Light
+	for _, key := range keys {
+		for _, light := range lights {
+			if light.Key() == key {
+				result = append(result, light)
+				break
+			}
+		}
+	}
+	return result
+}
 
-	url := fmt.Sprintf("http://%s/api/%s/lights", bridge.IP, bridge.Username)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get lights: %v", err)
+// selectTargets picks the lights to control among the bridge's, and the
+// targets to send their updates to: the lights themselves, or their room
+// or zone when they make up a whole one. Lights not given on the command
+// line are asked for, except on a refresh where the previous ones are
+// kept.
+func selectTargets(client *hue.Client, lights []hue.Light, opts *Options, previous []hue.Light) (selected, targets []hue.Light, err error) {
+	// Indices count in the bridge's own list, before rooms and zones
+	var indexedLight *hue.Light
+	if opts.LightIndex > 0 {
+		indexedLight, err = lightByIndex(lights, opts.LightIndex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select light: %v", err)
+		}
+		if !supportsMode(*indexedLight, opts.Mode) {
+			return nil, nil, fmt.Errorf("light %d (%s) doesn't support -mode %s", opts.LightIndex, indexedLight.Name, opts.Mode)
+		}
+		// The bridge doesn't promise to keep its order, show what we got
+		fmt.Printf("🔢 Light %d is %s\n", opts.LightIndex, indexedLight.Name)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	// Rooms and zones are offered next to the lights, a group call updates
+	// all their lights at once
+	groups, err := client.Groups()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read lights response: %v", err)
+		slog.Warn(fmt.Sprintf("⚠️  Rooms and zones won't be offered: %v", err))
 	}
+	groupLights := groupTargets(groups, lights)
+	lights = append(lights, groupLights...)
 
-	var lights []Light
-	result := gjson.ParseBytes(body)
+	// Only offer the lights that can follow the chosen mode. Targets have
+	// their own, checked with their lights in targetZones.
+	if len(opts.Targets) == 0 {
+		lights = lightsForMode(lights, opts.Mode)
+	}
+	if len(lights) == 0 {
+		return nil, nil, fmt.Errorf("no lights support -mode %s, use -mode brightness instead", opts.Mode)
+	}
+	if len(opts.LightTypes) > 0 {
+		typed := lightsOfType(lights, opts.LightTypes)
+		if len(typed) == 0 {
+			return nil, nil, fmt.Errorf("no lights match -light-type %s, the lights are: %s", strings.Join(opts.LightTypes, ","), lightKinds(lights))
+		}
+		lights = typed
+	}
 
-	result.ForEach(func(key, value gjson.Result) bool {
-		name := value.Get("name").String()
-		if name != "" {
-			lights = append(lights, Light{
-				ID:   key.String(),
-				Name: name,
-			})
+	// Let user select the light(s) to control
+	switch {
+	case indexedLight != nil:
+		selected = []hue.Light{*indexedLight}
+	case len(opts.Targets) > 0:
+		selected, err = targetLights(lights, opts.Targets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select the lights of -targets: %v", err)
 		}
-		return true
-	})
+	case opts.LightID != "":
+		selected, err = lightsByID(lights, opts.LightID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select light: %v", err)
+		}
+	case opts.LightName != "":
+		light, err := lightByName(lights, opts.LightName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select light: %v", err)
+		}
+		selected = []hue.Light{*light}
+	case len(opts.SavedLights) > 0 && previous == nil:
+		selected = lightsByKey(lights, opts.SavedLights)
+		if len(selected) == 0 {
+			return nil, nil, fmt.Errorf("none of the lights saved by setup are left on the bridge, run huemidi setup again")
+		}
+		fmt.Println("📁 Using the lights saved by setup")
+	case previous != nil:
+		selected = keepLights(lights, previous)
+		if len(selected) == 0 {
+			return nil, nil, fmt.Errorf("none of the selected lights are left on the bridge")
+		}
+	case opts.Multi:
+		selected, err = selectLights(lights)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select lights: %w", err)
+		}
+	default:
+		selectedLight, err := selectLight(lights)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to select light: %w", err)
+		}
+		selected = []hue.Light{*selectedLight}
+	}
 
-	if len(lights) == 0 {
-		return nil, fmt.Errorf("no lights found")
+	fmt.Printf("✅ Selected light: %s\n", lightNames(selected))
+	selectedIDs := make([]string, len(selected))
+	for i, light := range selected {
+		selectedIDs[i] = light.Key()
+	}
+	emitEvent("lights_selected", "ids", selectedIDs, "names", lightNames(selected))
+	for _, light := range selected {
+		if !light.Reachable {
+			slog.Warn(fmt.Sprintf("⚠️  %s is unreachable, is it switched off at the wall?", light.Name))
+		}
+		if !light.SupportsDimming && opts.Mode == ModeBrightness {
+			slog.Warn(fmt.Sprintf("⚠️  %s can't be dimmed, it will only switch on and off", light.Name))
+		}
+	}
+
+	// Lights making up a whole room or zone are driven with one group call
+	// instead of a call per light. Zones need every light on its own.
+	targets = selected
+	if opts.Zones == "" && len(opts.Targets) == 0 && !opts.NoGroupBatch && opts.Stream == "" {
+		if group := batchGroup(groupLights, selected); group != nil {
+			fmt.Printf("🔗 The selected lights are all of %s, updating them with a single group call\n", group.Name)
+			targets = []hue.Light{*group}
+		}
+	}
+
+	return selected, targets, nil
+}
+
+// keepLights returns the current version of the previously selected
+// lights that are still there. Lights added since are listed, as there is
+// no prompt to pick them.
+func keepLights(lights, previous []hue.Light) []hue.Light {
+	wanted := make(map[string]bool)
+	for _, light := range previous {
+		wanted[light.Key()] = true
 	}
 
-	return lights, nil
+	var kept, added []hue.Light
+	for _, light := range lights {
+		if wanted[light.Key()] {
+			kept = append(kept, light)
+		} else if !light.Group {
+			added = append(added, light)
+		}
+	}
+	if len(added) > 0 {
+		fmt.Printf("💡 Other lights on the bridge: %s (pick them with -light-id, or restart to choose again)\n", lightNames(added))
+	}
+	return kept
 }
 
-func selectLight(lights []Light) (*Light, error) {
+func selectLight(lights []hue.Light) (*hue.Light, error) {
 	templates := &promptui.SelectTemplates{
 		Label:    "{{ . }}?",
-		Active:   "▶ {{ .Name | cyan }}",
-		Inactive: "  {{ .Name | white }}",
+		Active:   "▶ {{ if .Group }}🏠 {{ end }}{{ .Name | cyan }} {{ printf \"(%s)\" .Kind | faint }}{{ if not .Reachable }} {{ \"unreachable\" | red }}{{ end }}",
+		Inactive: "  {{ if .Group }}🏠 {{ end }}{{ .Name | white }} {{ printf \"(%s)\" .Kind | faint }}{{ if not .Reachable }} {{ \"unreachable\" | red }}{{ end }}",
 		Selected: "✅ {{ .Name | green }}",
 	}
 
@@ -200,30 +1860,266 @@ func selectLight(lights []Light) (*Light, error) {
 
 	i, _, err := prompt.Run()
 	if err != nil {
-		return nil, err
+		return nil, promptError(err)
 	}
 
 	return &lights[i], nil
 }
 
-func calibrateMIDIKeyboard() (*MIDICalibration, error) {
-	fmt.Println("🎹 Calibrating MIDI keyboard...")
+// selectLights lets the user toggle any number of lights on and off the
+// selection, finishing with the "Done" entry.
+func selectLights(lights []hue.Light) ([]hue.Light, error) {
+	selected := make([]bool, len(lights))
+	cursor := 0
+
+	for {
+		count := 0
+		items := make([]string, 0, len(lights)+1)
+		for i, light := range lights {
+			mark := "[ ]"
+			if selected[i] {
+				mark = "[x]"
+				count++
+			}
+			name := light.Name
+			if light.Group {
+				name = "🏠 " + name
+			}
+			item := fmt.Sprintf("%s %s (%s)", mark, name, light.Kind())
+			if !light.Reachable {
+				item += " - unreachable"
+			}
+			items = append(items, item)
+		}
+		items = append(items, fmt.Sprintf("Done (%d selected)", count))
+
+		prompt := promptui.Select{
+			Label:        "Select lights to control (Enter toggles)",
+			Items:        items,
+			Size:         len(items),
+			HideSelected: true,
+			Templates: &promptui.SelectTemplates{
+				Label:    "{{ . }}?",
+				Active:   "▶ {{ . | cyan }}",
+				Inactive: "  {{ . | white }}",
+			},
+		}
 
-	defer midi.CloseDriver()
+		i, _, err := prompt.RunCursorAt(cursor, 0)
+		if err != nil {
+			return nil, promptError(err)
+		}
+		cursor = i
+
+		if i < len(lights) {
+			selected[i] = !selected[i]
+			continue
+		}
+
+		if count == 0 {
+			fmt.Println("Select at least one light")
+			continue
+		}
+
+		var result []hue.Light
+		for i, light := range lights {
+			if selected[i] {
+				result = append(result, light)
+			}
+		}
+		return result, nil
+	}
+}
+
+// lightsByID returns the lights matching a comma-separated list of IDs.
+func lightsByID(lights []hue.Light, ids string) ([]hue.Light, error) {
+	var result []hue.Light
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		found := false
+		for _, light := range lights {
+			if light.ID == id && !light.Group {
+				result = append(result, light)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no light with ID %q", id)
+		}
+	}
+	return result, nil
+}
+
+// lightByIndex returns the light at the 1-based index shown by
+// -list-lights.
+func lightByIndex(lights []hue.Light, index int) (*hue.Light, error) {
+	if index < 1 || index > len(lights) {
+		return nil, fmt.Errorf("no light number %d, the bridge has %d lights (see -list-lights)", index, len(lights))
+	}
+	return &lights[index-1], nil
+}
+
+// lightByName returns the light whose name matches, exactly or else as a
+// substring, ignoring case. No match or several matches are errors listing
+// the names to pick from.
+func lightByName(lights []hue.Light, name string) (*hue.Light, error) {
+	var matches []int
+	for i, light := range lights {
+		if strings.EqualFold(light.Name, name) {
+			return &lights[i], nil
+		}
+		if strings.Contains(strings.ToLower(light.Name), strings.ToLower(name)) {
+			matches = append(matches, i)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no light named %q, available lights: %s", name, lightNames(lights))
+	case 1:
+		return &lights[matches[0]], nil
+	default:
+		candidates := make([]hue.Light, len(matches))
+		for i, match := range matches {
+			candidates[i] = lights[match]
+		}
+		return nil, fmt.Errorf("%q matches several lights: %s", name, lightNames(candidates))
+	}
+}
+
+func lightNames(lights []hue.Light) string {
+	names := make([]string, len(lights))
+	for i, light := range lights {
+		names[i] = light.Name
+	}
+	return strings.Join(names, ", ")
+}
 
+// selectMIDIDevice picks the MIDI input named by device (an index or a
+// name), the only connected input, or asks the user to choose one.
+func selectMIDIDevice(device string) (drivers.In, error) {
 	ins := midi.GetInPorts()
 	if len(ins) == 0 {
 		return nil, fmt.Errorf("no MIDI input devices found")
 	}
 
-	fmt.Printf("Found MIDI devices:\n")
+	if device != "" {
+		if i, err := strconv.Atoi(device); err == nil {
+			if i < 0 || i >= len(ins) {
+				return nil, fmt.Errorf("MIDI device index %d out of range (0-%d)", i, len(ins)-1)
+			}
+			return ins[i], nil
+		}
+
+		// Exact names win over partial matches
+		for _, in := range ins {
+			if in.String() == device {
+				return in, nil
+			}
+		}
+		for _, in := range ins {
+			if strings.Contains(strings.ToLower(in.String()), strings.ToLower(device)) {
+				return in, nil
+			}
+		}
+		return nil, fmt.Errorf("no MIDI device matching %q, available devices:\n%s", device, ins.String())
+	}
+
+	if len(ins) == 1 {
+		return ins[0], nil
+	}
+
+	names := make([]string, len(ins))
 	for i, in := range ins {
-		fmt.Printf("  %d: %s\n", i, in.String())
+		names[i] = in.String()
+	}
+
+	prompt := promptui.Select{
+		Label: "Select a MIDI input device",
+		Items: names,
+		Templates: &promptui.SelectTemplates{
+			Label:    "{{ . }}?",
+			Active:   "▶ {{ . | cyan }}",
+			Inactive: "  {{ . | white }}",
+			Selected: "✅ {{ . | green }}",
+		},
+	}
+
+	i, _, err := prompt.Run()
+	if err != nil {
+		return nil, promptError(err)
+	}
+
+	return ins[i], nil
+}
+
+// selectMIDIDevices picks every MIDI input named in devices, or all of them
+// if devices is just "all".
+func selectMIDIDevices(devices []string) ([]drivers.In, error) {
+	if len(devices) == 1 && strings.EqualFold(devices[0], "all") {
+		ins := midi.GetInPorts()
+		if len(ins) == 0 {
+			return nil, fmt.Errorf("no MIDI input devices found")
+		}
+		return ins, nil
+	}
+
+	var ins []drivers.In
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		in, err := selectMIDIDevice(device)
+		if err != nil {
+			return nil, err
+		}
+		// Listening twice would handle every message twice
+		if !seen[in.String()] {
+			seen[in.String()] = true
+			ins = append(ins, in)
+		}
+	}
+	return ins, nil
+}
+
+// midiPortExists reports whether a MIDI input with exactly this name is
+// connected.
+func midiPortExists(name string) bool {
+	return findMIDIPort(name) != nil
+}
+
+// reopenMIDIDevice looks the device up again by name since it may have been
+// unplugged or renumbered since it was selected.
+func reopenMIDIDevice(in drivers.In) (drivers.In, error) {
+	port, err := midi.FindInPort(in.String())
+	if err != nil {
+		return nil, fmt.Errorf("MIDI device %q is no longer available: %v", in.String(), err)
+	}
+	return port, nil
+}
+
+// coarseStep is the brightness change per key, in percent, above which the
+// calibrated range is too short to dim smoothly, i.e. fewer than 10 keys.
+const coarseStep = 10
+
+// warnCoarseCalibration warns when the keys of the calibration are too few
+// for smooth brightness changes, unless the key position doesn't set the
+// brightness anyway.
+func warnCoarseCalibration(calibration *midimap.Calibration, opts *Options) {
+	if opts.Mapping == midimap.MappingVelocity || opts.PitchClass || calibration.Step() <= coarseStep {
+		return
 	}
+	slog.Warn(fmt.Sprintf("⚠️  Only %d keys between 0%% and 100%%, each key changes the brightness by %.0f%%", calibration.RightKey-calibration.LeftKey+1, calibration.Step()))
+	fmt.Println("   💡 Calibrate again over a wider range with -recalibrate, use -pitch-class, or control the brightness with -mapping velocity or -control cc")
+}
 
-	// Use the first available MIDI device
-	in := ins[0]
-	fmt.Printf("Using MIDI device: %s\n", in.String())
+// calibrateMIDIKeyboard learns the ends of the keyboard with the given
+// method, giving up once ctx is done.
+func calibrateMIDIKeyboard(ctx context.Context, in drivers.In, method string) (*midimap.Calibration, error) {
+	fmt.Println("🎹 Calibrating MIDI keyboard...")
+
+	if method == CalibrationSweep {
+		return sweepCalibration(ctx, in)
+	}
 
 	stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
 		// We'll handle this in the calibration process
@@ -233,40 +2129,39 @@ func calibrateMIDIKeyboard() (*MIDICalibration, error) {
 	}
 	defer stop()
 
-	calibration := &MIDICalibration{}
-
-	// Calibrate left key
-	fmt.Println("Press the LEFT-MOST key on your MIDI keyboard...")
-	leftKey, err := waitForMIDIKey(in)
+	// Calibrate left key. Playing the right-most key first reverses the
+	// keyboard.
+	fmt.Println("Press the LEFT-MOST key on your MIDI keyboard (or the right-most to reverse it)...")
+	leftKey, err := waitForMIDIKey(ctx, in)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get left key: %v", err)
+		return nil, fmt.Errorf("failed to get left key: %w", err)
 	}
-	calibration.LeftKey = leftKey
-	fmt.Printf("✅ Left key: %d\n", leftKey)
+	fmt.Printf("✅ 0%% key: %d\n", leftKey)
 
 	// Calibrate right key
-	fmt.Println("Press the RIGHT-MOST key on your MIDI keyboard...")
-	rightKey, err := waitForMIDIKey(in)
+	fmt.Println("Press the key at the other end of your MIDI keyboard...")
+	rightKey, err := waitForMIDIKey(ctx, in)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get right key: %v", err)
+		return nil, fmt.Errorf("failed to get right key: %w", err)
 	}
-	calibration.RightKey = rightKey
-	fmt.Printf("✅ Right key: %d\n", rightKey)
+	fmt.Printf("✅ 100%% key: %d\n", rightKey)
 
-	if calibration.LeftKey >= calibration.RightKey {
-		return nil, fmt.Errorf("left key (%d) should be less than right key (%d)", calibration.LeftKey, calibration.RightKey)
+	if leftKey == rightKey {
+		return nil, fmt.Errorf("both ends of the keyboard are key %d, press two different keys", leftKey)
 	}
 
-	return calibration, nil
+	return midimap.NewCalibration(leftKey, rightKey), nil
 }
 
-func waitForMIDIKey(in drivers.In) (uint8, error) {
-	keyChan := make(chan uint8, 1)
+// sweepCalibration has the user play a glissando across the keyboard and
+// uses the lowest and highest keys heard until sweepWindow after the first.
+func sweepCalibration(ctx context.Context, in drivers.In) (*midimap.Calibration, error) {
+	keyChan := make(chan uint8, 128)
 
 	stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
 		var channel, key, vel uint8
 
-		if msg.GetNoteOn(&channel, &key, &vel) {
+		if msg.GetNoteOn(&channel, &key, &vel) && vel > 0 {
 			select {
 			case keyChan <- key:
 			default:
@@ -274,108 +2169,169 @@ func waitForMIDIKey(in drivers.In) (uint8, error) {
 		}
 	}, midi.UseSysEx())
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("failed to listen to MIDI device: %v", err)
 	}
 	defer stop()
 
+	fmt.Println("Play across the WHOLE keyboard, from one end to the other...")
+
+	var low, high uint8
 	select {
 	case key := <-keyChan:
-		return key, nil
-	case <-time.After(30 * time.Second):
-		return 0, fmt.Errorf("timeout waiting for MIDI key press")
+		low, high = key, key
+	case <-time.After(keyTimeout):
+		return nil, errKeyTimeout
+	case <-ctx.Done():
+		return nil, errKeyCanceled
 	}
-}
 
-func startMIDIListener(bridge *HueBridge, light *Light, calibration *MIDICalibration) error {
-	fmt.Println("🎵 Starting MIDI listener... Press keys to control brightness!")
-	fmt.Printf("   Left key (%d) = 0%% brightness\n", calibration.LeftKey)
-	fmt.Printf("   Right key (%d) = 100%% brightness\n", calibration.RightKey)
-	fmt.Println("   Press Ctrl+C to exit")
+	deadline := time.After(sweepWindow)
+	for {
+		select {
+		case key := <-keyChan:
+			low, high = min(low, key), max(high, key)
+		case <-deadline:
+			if low == high {
+				return nil, fmt.Errorf("only key %d was played, sweep across the keyboard", low)
+			}
+			fmt.Printf("✅ Keys played: %d to %d\n", low, high)
+			return midimap.NewCalibration(low, high), nil
+		case <-ctx.Done():
+			return nil, errKeyCanceled
+		}
+	}
+}
 
-	ins := midi.GetInPorts()
-	if len(ins) == 0 {
-		return fmt.Errorf("no MIDI input devices found")
+// buildZones gives each light its own range of keys, either one octave per
+// light or ranges the user plays for each.
+func buildZones(ctx context.Context, in drivers.In, lights []hue.Light, opts *Options) ([]LightZone, error) {
+	if opts.Zones == ZonesOctave {
+		return octaveZones(lights, opts.ZoneOctave)
 	}
 
-	in := ins[0]
+	fmt.Println("🎹 Mapping key ranges to lights...")
 
-	stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
-		var channel, key, vel uint8
+	zones := make([]LightZone, 0, len(lights))
+	for _, light := range lights {
+		fmt.Printf("Press the LOWEST key for %s...\n", light.Name)
+		low, err := waitForMIDIKey(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get lowest key: %w", err)
+		}
 
-		if msg.GetNoteOn(&channel, &key, &vel) {
-			brightness := calculateBrightness(key, calibration)
-			err := setLightBrightness(bridge, light, brightness)
-			if err != nil {
-				fmt.Printf("❌ Failed to set brightness: %v\n", err)
-			} else {
-				fmt.Printf("🎹 Key %d → %d%% brightness\n", key, brightness)
-			}
+		fmt.Printf("Press the HIGHEST key for %s...\n", light.Name)
+		high, err := waitForMIDIKey(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get highest key: %w", err)
 		}
-	}, midi.UseSysEx())
-	if err != nil {
-		return fmt.Errorf("failed to listen to MIDI device: %v", err)
-	}
-	defer stop()
 
-	// Keep the program running
-	fmt.Println("Press Enter to exit...")
-	reader := bufio.NewReader(os.Stdin)
-	reader.ReadLine()
+		if low >= high {
+			return nil, fmt.Errorf("lowest key (%d) should be less than highest key (%d)", low, high)
+		}
 
-	return nil
-}
+		zone := LightZone{Range: KeyRange{Low: low, High: high}, Light: light}
+		for _, other := range zones {
+			if zone.Range.Low <= other.Range.High && other.Range.Low <= zone.Range.High {
+				return nil, fmt.Errorf("keys %s for %s overlap keys %s for %s", zone.Range, light.Name, other.Range, other.Light.Name)
+			}
+		}
 
-func calculateBrightness(key uint8, calibration *MIDICalibration) int {
-	if key <= calibration.LeftKey {
-		return 0
-	}
-	if key >= calibration.RightKey {
-		return 100
+		fmt.Printf("✅ %s: keys %s\n", light.Name, zone.Range)
+		zones = append(zones, zone)
 	}
 
-	// Linear interpolation between left and right keys
-	keyRange := float64(calibration.RightKey - calibration.LeftKey)
-	keyPosition := float64(key - calibration.LeftKey)
-	brightness := int((keyPosition / keyRange) * 100)
+	return zones, nil
+}
 
-	if brightness < 0 {
-		brightness = 0
-	}
-	if brightness > 100 {
-		brightness = 100
+// octaveZones maps consecutive octaves to the lights, starting with C of
+// the given octave (C4 is MIDI note 60).
+func octaveZones(lights []hue.Light, octave int) ([]LightZone, error) {
+	zones := make([]LightZone, len(lights))
+	for i, light := range lights {
+		low := 12 * (octave + 1 + i)
+		if low < 0 || low+11 > 127 {
+			return nil, fmt.Errorf("not enough octaves above C%d for %d lights", octave, len(lights))
+		}
+		zones[i] = LightZone{Range: KeyRange{Low: uint8(low), High: uint8(low + 11)}, Light: light}
 	}
-
-	return brightness
+	return zones, nil
 }
 
-func setLightBrightness(bridge *HueBridge, light *Light, brightness int) error {
-	// Convert percentage to Hue brightness scale (0-254)
-	hueBrightness := int(float64(brightness) * 254.0 / 100.0)
-	if hueBrightness < 1 && brightness > 0 {
-		hueBrightness = 1 // Minimum brightness when not off
-	}
+// Errors from waitForMIDIKey, for telling a key that never came from the
+// user giving up. Giving up is errPromptCanceled too, so it exits the same
+// way as Ctrl+C in a prompt.
+var (
+	errKeyTimeout  = errors.New("timeout waiting for MIDI key press")
+	errKeyCanceled = fmt.Errorf("%w waiting for MIDI key press", errPromptCanceled)
+)
 
-	var requestBody string
-	if brightness == 0 {
-		requestBody = `{"on":false}`
-	} else {
-		requestBody = fmt.Sprintf(`{"on":true,"bri":%d}`, hueBrightness)
-	}
+// keyTimeout is how long waitForMIDIKey waits for a key.
+const keyTimeout = 30 * time.Second
+
+// waitForMIDIKey returns the next key pressed. Only note on messages count:
+// clock, active sensing and other traffic is skipped without restarting the
+// wait. It fails with errKeyTimeout after keyTimeout or errKeyCanceled once
+// ctx is done.
+func waitForMIDIKey(ctx context.Context, in drivers.In) (uint8, error) {
+	keyChan := make(chan uint8, 1)
 
-	url := fmt.Sprintf("http://%s/api/%s/lights/%s/state", bridge.IP, bridge.Username, light.ID)
+	stop, err := midi.ListenTo(in, func(msg midi.Message, timestampms int32) {
+		var channel, key, vel uint8
 
-	req, err := http.NewRequest("PUT", url, strings.NewReader(requestBody))
+		switch {
+		case msg.Is(midi.RealTimeMsg) || msg.Is(midi.SysCommonMsg) || msg.Is(midi.SysExMsg):
+			// Clock ticks and active sensing keep coming while nothing is played
+		case msg.GetNoteOn(&channel, &key, &vel) && vel > 0:
+			select {
+			case keyChan <- key:
+			default:
+			}
+		default:
+			// A release of the previous key, a knob or the pitch wheel
+			slog.Debug("Ignoring MIDI message while waiting for a key", "msg", msg.String())
+		}
+	}, midi.UseSysEx())
 	if err != nil {
-		return err
+		return 0, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	defer stop()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	timeout := time.NewTimer(keyTimeout)
+	defer timeout.Stop()
+
+	select {
+	case key := <-keyChan:
+		return key, nil
+	case <-timeout.C:
+		return 0, errKeyTimeout
+	case <-ctx.Done():
+		return 0, errKeyCanceled
 	}
-	defer resp.Body.Close()
+}
 
-	return nil
+// waitForExit blocks until the user presses Enter or the process receives
+// SIGINT/SIGTERM, so that deferred cleanup (stopping the listener, closing
+// the MIDI driver) runs instead of the process being killed outright.
+func waitForExit() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	enter := make(chan struct{})
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		// Without a usable stdin (e.g. under a service manager) only a
+		// signal ends the session.
+		if _, _, err := reader.ReadLine(); err == nil {
+			close(enter)
+		}
+	}()
+
+	fmt.Println("Press Enter or Ctrl+C to exit...")
+	select {
+	case <-sigs:
+		fmt.Println()
+	case <-enter:
+	}
+	fmt.Println("👋 Shutting down...")
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics exported on -metrics-addr in the Prometheus text format. Updating
+// them is a few atomic operations, cheap enough to leave on when nothing
+// scrapes them.
+var (
+	midiNotesTotal   atomic.Int64
+	apiRequestsTotal atomic.Int64
+	apiErrorsTotal   atomic.Int64
+
+	setBrightnessDuration = newHistogram(0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5)
+)
+
+// bridgeMetrics feeds the metrics from the Hue client.
+type bridgeMetrics struct{}
+
+func (bridgeMetrics) Request(err error) {
+	apiRequestsTotal.Add(1)
+	if err != nil {
+		apiErrorsTotal.Add(1)
+	}
+}
+
+func (bridgeMetrics) SetBrightness(d time.Duration) {
+	setBrightnessDuration.Observe(d)
+}
+
+// histogram counts observations in cumulative buckets, in seconds.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]int64, len(bounds))}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+func writeCounter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "huemidi_midi_notes_total", "MIDI notes received.", midiNotesTotal.Load())
+	writeCounter(w, "huemidi_api_requests_total", "Requests sent to the Hue bridge.", apiRequestsTotal.Load())
+	writeCounter(w, "huemidi_api_errors_total", "Requests to the Hue bridge that failed.", apiErrorsTotal.Load())
+	setBrightnessDuration.write(w, "huemidi_set_brightness_duration_seconds", "Time taken to set the brightness of a light.")
+}
+
+// serveMetrics starts the metrics endpoint on addr and returns a function
+// shutting it down.
+func serveMetrics(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start metrics server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error(fmt.Sprintf("❌ Metrics server stopped: %v", err))
+		}
+	}()
+	fmt.Printf("📈 Metrics on http://%s/metrics\n", listener.Addr())
+
+	return func() { server.Close() }, nil
+}
@@ -0,0 +1,65 @@
+// Package midimap turns MIDI input into Hue light levels: key positions
+// across a calibrated keyboard, velocities, controllers and wheels mapped
+// to brightnesses, hues and color temperatures.
+package midimap
+
+// Calibration spans the keys between LeftKey and RightKey, LeftKey being
+// the lower one. The left key is 0% unless Reversed is set, in which case
+// high notes are dark and low notes bright.
+type Calibration struct {
+	LeftKey  uint8
+	RightKey uint8
+	Reversed bool
+}
+
+// NewCalibration builds a calibration from the key for 0% and the key for
+// 100%, which may be in descending order.
+func NewCalibration(zeroKey, fullKey uint8) *Calibration {
+	if zeroKey > fullKey {
+		return &Calibration{LeftKey: fullKey, RightKey: zeroKey, Reversed: true}
+	}
+	return &Calibration{LeftKey: zeroKey, RightKey: fullKey}
+}
+
+// Ends returns the 0% key and the 100% key.
+func (c *Calibration) Ends() (zeroKey, fullKey uint8) {
+	if c.Reversed {
+		return c.RightKey, c.LeftKey
+	}
+	return c.LeftKey, c.RightKey
+}
+
+// Step returns how much the brightness changes from one key to the next
+// across the calibrated range, in percent.
+func (c *Calibration) Step() float64 {
+	return 100 / float64(c.RightKey-c.LeftKey)
+}
+
+// PitchClass returns a calibration spanning the octave of key, from its C
+// to its B, in the direction of calibration. Every octave then covers the
+// whole range, trading where a key is on the keyboard for finer steps on
+// small keyboards.
+func PitchClass(key uint8, calibration *Calibration) *Calibration {
+	c := key - key%12
+	return &Calibration{LeftKey: c, RightKey: c + 11, Reversed: calibration.Reversed}
+}
+
+// Position returns how far key is across the calibrated range, from 0 at
+// the 0% key to 1 at the 100% key.
+func (c *Calibration) Position(key uint8) float64 {
+	var position float64
+	switch {
+	case key <= c.LeftKey:
+		position = 0
+	case key >= c.RightKey:
+		position = 1
+	default:
+		// Linear interpolation between left and right keys
+		position = float64(key-c.LeftKey) / float64(c.RightKey-c.LeftKey)
+	}
+
+	if c.Reversed {
+		return 1 - position
+	}
+	return position
+}
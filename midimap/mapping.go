@@ -0,0 +1,166 @@
+package midimap
+
+import (
+	"math"
+	"time"
+
+	"huemidi/hue"
+)
+
+// Supported values for the mapping argument of NoteBrightness.
+const (
+	// MappingKey uses the key position across the calibrated range.
+	MappingKey = "key"
+	// MappingVelocity uses only how hard the key was struck.
+	MappingVelocity = "velocity"
+	// MappingKeyVelocity lets the key pick a base level that the velocity
+	// then scales.
+	MappingKeyVelocity = "key+velocity"
+)
+
+// Supported values for Curve.Shape.
+const (
+	// CurveLinear keeps the key position as is.
+	CurveLinear = "linear"
+	// CurveLog changes quickly on the low keys and slowly on the high
+	// ones.
+	CurveLog = "log"
+	// CurveExp changes slowly on the low keys and quickly on the high
+	// ones.
+	CurveExp = "exp"
+	// CurveGamma raises the position to the power of Curve.Gamma.
+	CurveGamma = "gamma"
+)
+
+// Curve maps a key position between 0 and 1 to another one, to make the
+// brightness steps follow how the eye perceives them.
+type Curve struct {
+	Shape string
+	Gamma float64
+}
+
+// Apply maps a position through the curve.
+func (c Curve) Apply(x float64) float64 {
+	x = min(max(x, 0), 1)
+	switch c.Shape {
+	case CurveLog:
+		return math.Log10(1 + 9*x)
+	case CurveExp:
+		return (math.Pow(10, x) - 1) / 9
+	case CurveGamma:
+		return math.Pow(x, c.Gamma)
+	default:
+		return x
+	}
+}
+
+// Brightness maps a key across the calibrated range to 0-100%.
+func Brightness(key uint8, calibration *Calibration, curve Curve) int {
+	brightness := int(curve.Apply(calibration.Position(key)) * 100)
+
+	if brightness < 0 {
+		brightness = 0
+	}
+	if brightness > 100 {
+		brightness = 100
+	}
+
+	return brightness
+}
+
+// ColorTemp maps a key across the calibrated range to a color
+// temperature, from warm at the left key to cool at the right key.
+func ColorTemp(key uint8, calibration *Calibration) int {
+	return hue.MaxColorTemp - int(calibration.Position(key)*(hue.MaxColorTemp-hue.MinColorTemp))
+}
+
+// PressureSaturation maps aftertouch pressure (0-127) to a saturation:
+// pressing harder washes the color out toward white, and easing off
+// (pressure 0) brings back full color.
+func PressureSaturation(pressure uint8) int {
+	return hue.MaxSat - int(float64(min(pressure, 127))/127*hue.MaxSat)
+}
+
+// Hue maps a key across the calibrated range to the color wheel.
+func Hue(key uint8, calibration *Calibration) int {
+	return int(calibration.Position(key) * hue.MaxHue)
+}
+
+// VelocityBrightness maps a MIDI velocity (0-127) to 0-100%.
+func VelocityBrightness(vel uint8) int {
+	if vel > 127 {
+		vel = 127
+	}
+	return int(float64(vel) / 127.0 * 100)
+}
+
+// CCBrightness maps a Control Change value (0-127) to 0-100%.
+func CCBrightness(value uint8) int {
+	return VelocityBrightness(value)
+}
+
+// CCHue maps a Control Change value (0-127) to the whole color wheel.
+func CCHue(value uint8) int {
+	return int(float64(min(value, 127)) / 127 * hue.MaxHue)
+}
+
+// CCColorTemp maps a Control Change value (0-127) to a color
+// temperature, from warm at 0 to cool at 127.
+func CCColorTemp(value uint8) int {
+	return hue.MaxColorTemp - int(float64(min(value, 127))/127*(hue.MaxColorTemp-hue.MinColorTemp))
+}
+
+// CCSaturation maps a Control Change value (0-127) to 0-254.
+func CCSaturation(value uint8) int {
+	return int(float64(min(value, 127)) / 127 * hue.MaxSat)
+}
+
+// Fade times Control Change values are mapped to by CCTransition, in the
+// 100ms steps of the bridge, from snappy to dreamy.
+const (
+	MinCCTransition = 100 * time.Millisecond
+	MaxCCTransition = 5 * time.Second
+)
+
+// CCTransition maps a Control Change value (0-127) to a transition between
+// MinCCTransition and MaxCCTransition, rounded to 100ms.
+func CCTransition(value uint8) time.Duration {
+	span := float64(MaxCCTransition-MinCCTransition) / float64(100*time.Millisecond)
+	steps := math.Round(float64(min(value, 127)) / 127 * span)
+	return MinCCTransition + time.Duration(steps)*100*time.Millisecond
+}
+
+// BendOffset maps a 14-bit pitch bend, relative to the center (-8192 to
+// 8191), to a brightness offset of up to ±bendRange percent.
+func BendOffset(bend int16, bendRange int) int {
+	return int(math.Round(float64(bend) / 8192 * float64(bendRange)))
+}
+
+// ClampBrightness keeps a brightness within 0-100%.
+func ClampBrightness(brightness int) int {
+	return min(max(brightness, 0), 100)
+}
+
+// ClampColorTemp keeps a color temperature within what the lights accept,
+// in mireds.
+func ClampColorTemp(mireds int) int {
+	return min(max(mireds, hue.MinColorTemp), hue.MaxColorTemp)
+}
+
+// ClampHue keeps a hue on the color wheel.
+func ClampHue(value int) int {
+	return min(max(value, 0), hue.MaxHue)
+}
+
+// NoteBrightness applies a Mapping* mode to a note.
+func NoteBrightness(key, vel uint8, calibration *Calibration, mapping string, curve Curve) int {
+	switch mapping {
+	case MappingVelocity:
+		return VelocityBrightness(vel)
+	case MappingKeyVelocity:
+		base := Brightness(key, calibration, curve)
+		return int(float64(base) * float64(vel) / 127.0)
+	default:
+		return Brightness(key, calibration, curve)
+	}
+}
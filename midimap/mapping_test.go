@@ -0,0 +1,61 @@
+package midimap
+
+import "testing"
+
+func TestBrightness(t *testing.T) {
+	linear := Curve{Shape: CurveLinear}
+	tests := []struct {
+		name        string
+		key         uint8
+		calibration *Calibration
+		want        int
+	}{
+		{"left key", 48, NewCalibration(48, 72), 0},
+		{"right key", 72, NewCalibration(48, 72), 100},
+		{"midpoint", 60, NewCalibration(48, 72), 50},
+		{"between", 54, NewCalibration(48, 72), 25},
+		{"below left key", 21, NewCalibration(48, 72), 0},
+		{"above right key", 108, NewCalibration(48, 72), 100},
+		{"lowest note", 0, NewCalibration(48, 72), 0},
+		{"highest note", 127, NewCalibration(48, 72), 100},
+		{"reversed left key", 48, NewCalibration(72, 48), 100},
+		{"reversed right key", 72, NewCalibration(72, 48), 0},
+		{"reversed midpoint", 60, NewCalibration(72, 48), 50},
+		{"reversed below left key", 21, NewCalibration(72, 48), 100},
+		{"reversed above right key", 108, NewCalibration(72, 48), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Brightness(tt.key, tt.calibration, linear); got != tt.want {
+				t.Errorf("Brightness(%d) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrightnessCurveClamped(t *testing.T) {
+	calibration := NewCalibration(48, 72)
+	curves := []Curve{
+		{Shape: CurveLinear},
+		{Shape: CurveLog},
+		{Shape: CurveExp},
+		{Shape: CurveGamma, Gamma: 2.2},
+		{Shape: CurveGamma, Gamma: 0.1},
+	}
+
+	for _, curve := range curves {
+		for key := 0; key <= 127; key++ {
+			got := Brightness(uint8(key), calibration, curve)
+			if got < 0 || got > 100 {
+				t.Errorf("%s curve: Brightness(%d) = %d, want 0-100", curve.Shape, key, got)
+			}
+		}
+		if got := Brightness(48, calibration, curve); got != 0 {
+			t.Errorf("%s curve: Brightness(48) = %d, want 0", curve.Shape, got)
+		}
+		if got := Brightness(72, calibration, curve); got != 100 {
+			t.Errorf("%s curve: Brightness(72) = %d, want 100", curve.Shape, got)
+		}
+	}
+}
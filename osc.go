@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+)
+
+// oscBrightness is the OSC address setting the brightness, as sent by a
+// fader in TouchOSC and similar apps.
+const oscBrightness = "/brightness"
+
+// oscMessage is a decoded OSC message. Only numeric arguments are kept,
+// floats and integers alike as float64.
+type oscMessage struct {
+	Address string
+	Types   string
+	Args    []float64
+}
+
+// serveOSC starts listening for OSC messages over UDP on addr, letting a
+// tablet or phone app drive the selected lights next to the MIDI input:
+//
+//	/brightness f   0.0-1.0
+//	/brightness i   0-100
+//
+// The returned function stops listening.
+func (l *midiListener) serveOSC(addr string) (func(), error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start OSC listener: %v", err)
+	}
+
+	go func() {
+		// Larger packets than this don't fit in a UDP datagram anyway
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error(fmt.Sprintf("❌ OSC listener stopped: %v", err))
+				}
+				return
+			}
+
+			messages, err := parseOSCPacket(buf[:n])
+			if err != nil {
+				slog.Debug("Ignoring malformed OSC packet", "err", err)
+				continue
+			}
+			for _, msg := range messages {
+				l.handleOSC(msg)
+			}
+		}
+	}()
+	fmt.Printf("   OSC control on udp://%s (%s)\n", conn.LocalAddr(), oscBrightness)
+
+	return func() { conn.Close() }, nil
+}
+
+func (l *midiListener) handleOSC(msg oscMessage) {
+	slog.Debug("📡 OSC message", "address", msg.Address, "types", msg.Types, "args", msg.Args)
+
+	if msg.Address != oscBrightness || len(msg.Args) == 0 {
+		return
+	}
+
+	// Faders send floats between 0 and 1, integers are percentages
+	value := msg.Args[0]
+	if msg.Types[0] == 'f' || msg.Types[0] == 'd' {
+		value *= 100
+	}
+	brightness := int(math.Round(min(max(value, 0), 100)))
+
+	l.setBrightness(brightness)
+	slog.Info(fmt.Sprintf("📡 OSC %s → %d%% brightness", msg.Address, brightness))
+}
+
+// parseOSCPacket decodes an OSC message, or the messages of a bundle.
+// Bundle time tags are ignored, everything is applied as it arrives.
+func parseOSCPacket(data []byte) ([]oscMessage, error) {
+	if !bytes.HasPrefix(data, []byte("#bundle\x00")) {
+		msg, err := parseOSCMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		return []oscMessage{msg}, nil
+	}
+
+	// The bundle name is followed by an 8-byte time tag, then the
+	// elements, each prefixed with its size
+	data = data[min(16, len(data)):]
+	var messages []oscMessage
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated bundle element")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || size > len(data) {
+			return nil, fmt.Errorf("bundle element of %d bytes in %d", size, len(data))
+		}
+		element, err := parseOSCPacket(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, element...)
+		data = data[size:]
+	}
+	return messages, nil
+}
+
+// parseOSCMessage decodes a single OSC message.
+func parseOSCMessage(data []byte) (oscMessage, error) {
+	var msg oscMessage
+
+	address, data, err := readOSCString(data)
+	if err != nil {
+		return msg, fmt.Errorf("bad address: %v", err)
+	}
+	if !strings.HasPrefix(address, "/") {
+		return msg, fmt.Errorf("address %q doesn't start with /", address)
+	}
+	msg.Address = address
+
+	// Very old senders leave out the type tags, there are no arguments
+	// we could read then
+	if len(data) == 0 {
+		return msg, nil
+	}
+	tags, data, err := readOSCString(data)
+	if err != nil || !strings.HasPrefix(tags, ",") {
+		return msg, fmt.Errorf("bad type tags %q", tags)
+	}
+	msg.Types = tags[1:]
+
+	for _, tag := range msg.Types {
+		switch tag {
+		case 'f', 'i':
+			if len(data) < 4 {
+				return msg, fmt.Errorf("truncated %c argument", tag)
+			}
+			bits := binary.BigEndian.Uint32(data)
+			if tag == 'f' {
+				msg.Args = append(msg.Args, float64(math.Float32frombits(bits)))
+			} else {
+				msg.Args = append(msg.Args, float64(int32(bits)))
+			}
+			data = data[4:]
+		case 'd':
+			if len(data) < 8 {
+				return msg, fmt.Errorf("truncated d argument")
+			}
+			msg.Args = append(msg.Args, math.Float64frombits(binary.BigEndian.Uint64(data)))
+			data = data[8:]
+		default:
+			// Anything else would need to be skipped by its size, which
+			// we don't know for every type; stop at the numbers so far
+			msg.Types = msg.Types[:len(msg.Args)]
+			return msg, nil
+		}
+	}
+	return msg, nil
+}
+
+// readOSCString reads a null-terminated string padded to 4 bytes, and
+// returns what follows it.
+func readOSCString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, fmt.Errorf("unterminated string")
+	}
+	padded := (end + 4) &^ 3
+	if padded > len(data) {
+		padded = len(data)
+	}
+	return string(data[:end]), data[padded:], nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"huemidi/hue"
+)
+
+// rampStep is the shortest delay between two brightnesses of a ramp, about
+// the rate a single light can be updated at.
+const rampStep = 100 * time.Millisecond
+
+// Ramper moves the brightness of each light toward its target over a
+// fixed duration, sending the brightnesses in between instead of jumping.
+// A new target supersedes the previous one, the ramp starting over from
+// wherever the light got to.
+type Ramper struct {
+	duration time.Duration
+	step     time.Duration
+	send     func(light *hue.Light, brightness int)
+
+	mu    sync.Mutex
+	ramps map[string]*ramp
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// ramp is the ramp state of one light.
+type ramp struct {
+	light    *hue.Light
+	from, to int
+	start    time.Time
+	// current is the last brightness sent.
+	current int
+	active  bool
+}
+
+// newRamper returns a Ramper taking duration to reach a target, sending
+// at most one brightness per step for each light through send.
+func newRamper(duration, step time.Duration, send func(light *hue.Light, brightness int)) *Ramper {
+	return &Ramper{
+		duration: duration,
+		step:     max(step, rampStep),
+		send:     send,
+		ramps:    make(map[string]*ramp),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Move ramps the light to brightness. The first target of a light is sent
+// right away since where the light starts from isn't known.
+func (r *Ramper) Move(light *hue.Light, brightness int) {
+	r.mu.Lock()
+	rp, ok := r.ramps[light.Key()]
+	if !ok {
+		r.ramps[light.Key()] = &ramp{light: light, from: brightness, to: brightness, current: brightness}
+		r.mu.Unlock()
+		r.send(light, brightness)
+		return
+	}
+	defer r.mu.Unlock()
+
+	rp.from, rp.to, rp.start = rp.current, brightness, time.Now()
+	if rp.active {
+		return
+	}
+
+	rp.active = true
+	r.wg.Add(1)
+	go r.run(rp)
+}
+
+// run sends the brightnesses of a ramp, one per step, until it reaches its
+// target or the Ramper is stopped.
+func (r *Ramper) run(rp *ramp) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.step)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		r.mu.Lock()
+		brightness := rp.to
+		if elapsed := time.Since(rp.start); elapsed < r.duration {
+			brightness = rp.from + int(float64(rp.to-rp.from)*float64(elapsed)/float64(r.duration))
+		}
+		changed := brightness != rp.current
+		rp.current = brightness
+		done := brightness == rp.to
+		if done {
+			rp.active = false
+		}
+		r.mu.Unlock()
+
+		if changed {
+			r.send(rp.light, brightness)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// Stop abandons the ramps in progress and waits for them to end.
+func (r *Ramper) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
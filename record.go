@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"gitlab.com/gomidi/midi/v2"
+)
+
+// recordedMessage is a line of a -record file: when the message came in
+// since the recording started, and its bytes in hex.
+type recordedMessage struct {
+	TimeMS int64  `json:"time_ms"`
+	Data   string `json:"data"`
+	// Message describes the message for humans, replaying ignores it.
+	Message string `json:"message,omitempty"`
+}
+
+// recorder writes the MIDI messages of a session to a file, one JSON
+// line each, for -replay.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+	return &recorder{file: file, w: bufio.NewWriter(file), start: time.Now()}, nil
+}
+
+// record appends a message. Clock ticks and other real-time messages drive
+// nothing, they are left out to keep recordings small.
+func (r *recorder) record(msg midi.Message) {
+	if msg.Is(midi.RealTimeMsg) {
+		return
+	}
+
+	line, err := json.Marshal(recordedMessage{
+		TimeMS:  time.Since(r.start).Milliseconds(),
+		Data:    hex.EncodeToString(msg),
+		Message: msg.String(),
+	})
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(append(line, '\n'))
+}
+
+// Close writes what is left of the recording.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return fmt.Errorf("failed to write recording: %v", err)
+	}
+	return r.file.Close()
+}
+
+// loadRecording reads the messages of a -record file.
+func loadRecording(path string) ([]recordedMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	var messages []recordedMessage
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg recordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, err := hex.DecodeString(msg.Data); err != nil || msg.TimeMS < 0 {
+			return nil, fmt.Errorf("line %d: expected a time_ms and the hex data of a MIDI message", line)
+		}
+		messages = append(messages, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %v", err)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("the recording has no messages")
+	}
+	return messages, nil
+}
+
+// replay feeds recorded messages to handle with their original timing,
+// until the end of the recording or ctx is done.
+func replay(ctx context.Context, messages []recordedMessage, handle func(msg midi.Message, timestampms int32)) {
+	start := time.Now()
+	for _, recorded := range messages {
+		select {
+		case <-time.After(time.Until(start.Add(time.Duration(recorded.TimeMS) * time.Millisecond))):
+		case <-ctx.Done():
+			return
+		}
+
+		data, _ := hex.DecodeString(recorded.Data)
+		handle(midi.Message(data), int32(recorded.TimeMS))
+	}
+	slog.Info("⏹️  Replay finished")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"huemidi/hue"
+)
+
+// parseSceneBindings parses a list of note=scene pairs such as
+// "60=Relax,62=Concentrate". Scenes are given by name or ID.
+func parseSceneBindings(value string) (map[uint8]string, error) {
+	bindings := make(map[uint8]string)
+	if value == "" {
+		return bindings, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		note, scene, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || scene == "" {
+			return nil, fmt.Errorf("expected note=scene, got %q", pair)
+		}
+		number, err := strconv.Atoi(note)
+		if err != nil || number < 0 || number > 127 {
+			return nil, fmt.Errorf("note %q should be a MIDI note between 0 and 127", note)
+		}
+		bindings[uint8(number)] = scene
+	}
+
+	return bindings, nil
+}
+
+// resolveScenes looks up the scenes bound to notes, by ID first and then
+// by case-insensitive name. A name shared by scenes of different rooms has
+// to be given by ID.
+func resolveScenes(scenes []hue.Scene, bindings map[uint8]string) (map[uint8]hue.Scene, error) {
+	resolved := make(map[uint8]hue.Scene)
+	for note, wanted := range bindings {
+		var matches []hue.Scene
+		for _, scene := range scenes {
+			if scene.ID == wanted {
+				matches = []hue.Scene{scene}
+				break
+			}
+			if strings.EqualFold(scene.Name, wanted) {
+				matches = append(matches, scene)
+			}
+		}
+
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("no scene named %q", wanted)
+		case 1:
+			resolved[note] = matches[0]
+		default:
+			ids := make([]string, len(matches))
+			for i, scene := range matches {
+				ids[i] = scene.ID
+			}
+			return nil, fmt.Errorf("several scenes are named %q, use one of the IDs %s", wanted, strings.Join(ids, ", "))
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"huemidi/hue"
+)
+
+// captureLightStates snapshots every light, skipping (with a warning) the
+// ones whose state can't be read.
+func captureLightStates(client *hue.Client, lights []hue.Light) map[string]*hue.LightState {
+	states := make(map[string]*hue.LightState)
+	for i := range lights {
+		state, err := client.CaptureState(&lights[i])
+		if err != nil {
+			slog.Warn(fmt.Sprintf("⚠️  Won't restore %s on exit: %v", lights[i].Name, err))
+			continue
+		}
+		states[lights[i].Key()] = state
+	}
+	return states
+}
+
+func restoreLightStates(client *hue.Client, lights []hue.Light, states map[string]*hue.LightState) {
+	for i := range lights {
+		state, ok := states[lights[i].Key()]
+		if !ok {
+			continue
+		}
+		if err := client.RestoreState(&lights[i], state); err != nil {
+			slog.Error(fmt.Sprintf("❌ Failed to restore %s: %v", lights[i].Name, err))
+		}
+	}
+	if len(states) > 0 {
+		slog.Info("↩️  Restored lights to their original state")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"huemidi/hue"
+	"huemidi/midimap"
+)
+
+// Target says in a targets file how one light is driven: by its own range
+// of keys, its own controller, or both, each light in its own mode.
+type Target struct {
+	// Light is the name or ID of the light, room or zone.
+	Light string `json:"light"`
+	// Keys is a range of notes such as "48-59", mapped across the light's
+	// levels like a calibrated keyboard.
+	Keys string `json:"keys,omitempty"`
+	// CC is a Control Change number driving the light alone, 0 for none.
+	CC int `json:"cc,omitempty"`
+	// Mode is the Mode* constant the light follows, -mode when empty.
+	Mode string `json:"mode,omitempty"`
+
+	// keys is Keys parsed.
+	keys KeyRange
+}
+
+// TargetsFile is the format of the file given with -targets.
+type TargetsFile struct {
+	Targets []Target `json:"targets"`
+}
+
+// loadTargets reads and validates a targets file. Two targets can't share
+// keys or a controller, as a message would have to pick one.
+func loadTargets(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets: %v", err)
+	}
+
+	var file TargetsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse targets %s: %v", path, err)
+	}
+	if len(file.Targets) == 0 {
+		return nil, fmt.Errorf("%s has no targets", path)
+	}
+
+	ccs := make(map[int]int)
+	for i := range file.Targets {
+		target := &file.Targets[i]
+		if err := target.validate(); err != nil {
+			return nil, fmt.Errorf("target %d: %v", i+1, err)
+		}
+
+		if target.CC > 0 {
+			if other, ok := ccs[target.CC]; ok {
+				return nil, fmt.Errorf("target %d: CC%d is already used by target %d", i+1, target.CC, other+1)
+			}
+			ccs[target.CC] = i
+		}
+		if target.Keys == "" {
+			continue
+		}
+		for j, other := range file.Targets[:i] {
+			if other.Keys != "" && target.keys.Low <= other.keys.High && other.keys.Low <= target.keys.High {
+				return nil, fmt.Errorf("target %d: keys %s overlap keys %s of target %d", i+1, target.keys, other.keys, j+1)
+			}
+		}
+	}
+
+	return file.Targets, nil
+}
+
+func (t *Target) validate() error {
+	if t.Light == "" {
+		return fmt.Errorf("no light")
+	}
+	if t.Keys == "" && t.CC == 0 {
+		return fmt.Errorf("%s has neither keys nor a cc", t.Light)
+	}
+
+	if t.Keys != "" {
+		low, high, ok := strings.Cut(t.Keys, "-")
+		lowKey, lowErr := strconv.Atoi(strings.TrimSpace(low))
+		highKey, highErr := strconv.Atoi(strings.TrimSpace(high))
+		if !ok || lowErr != nil || highErr != nil || lowKey < 0 || highKey > 127 || lowKey >= highKey {
+			return fmt.Errorf("invalid keys %q: expected low-high notes, e.g. 48-59", t.Keys)
+		}
+		t.keys = KeyRange{Low: uint8(lowKey), High: uint8(highKey)}
+	}
+
+	// CC0 is bank select, and 120 and above are channel mode messages
+	if t.CC < 0 || t.CC > 119 {
+		return fmt.Errorf("invalid cc %d: expected 1-119", t.CC)
+	}
+
+	switch t.Mode {
+	case "", ModeBrightness, ModeColor, ModeColorTemp:
+	default:
+		return fmt.Errorf("invalid mode %q: expected %s, %s or %s", t.Mode, ModeBrightness, ModeColor, ModeColorTemp)
+	}
+
+	return nil
+}
+
+// checkTargetConflicts makes sure the keys and controllers of the targets
+// aren't taken by other flags, which are handled first and would hide
+// them.
+func checkTargetConflicts(targets []Target, opts *Options) error {
+	keys := map[int]string{opts.ToggleKey: "-toggle-key", opts.UpKey: "-up-key", opts.DownKey: "-down-key"}
+	for key := range opts.Scenes {
+		keys[int(key)] = "-scenes"
+	}
+	ccs := map[int]string{opts.LatchCC: "-latch-cc", opts.TransitionCC: "-transition-cc", opts.HueCC: "-hue-cc", opts.SatCC: "-sat-cc", sustainPedal: "the sustain pedal"}
+	if opts.Control != ControlNotes {
+		ccs[opts.CC] = "-cc"
+	}
+
+	for _, target := range targets {
+		if target.Keys != "" {
+			for key, flag := range keys {
+				if key >= 0 && target.keys.Contains(uint8(key)) {
+					return fmt.Errorf("key %d of %s is also %s", key, target.Light, flag)
+				}
+			}
+		}
+		if flag, ok := ccs[target.CC]; ok && target.CC > 0 {
+			return fmt.Errorf("CC%d of %s is also %s", target.CC, target.Light, flag)
+		}
+	}
+	return nil
+}
+
+// targetLights returns the lights named by the targets, by ID or else by
+// name as -light-name matches them.
+func targetLights(lights []hue.Light, targets []Target) ([]hue.Light, error) {
+	selected := make([]hue.Light, 0, len(targets))
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		light, err := targetLight(lights, target.Light)
+		if err != nil {
+			return nil, err
+		}
+		if seen[light.Key()] {
+			return nil, fmt.Errorf("%s is the light of two targets, give it both keys and a cc in one", light.Name)
+		}
+		seen[light.Key()] = true
+		selected = append(selected, *light)
+	}
+	return selected, nil
+}
+
+func targetLight(lights []hue.Light, name string) (*hue.Light, error) {
+	for i := range lights {
+		if lights[i].ID == name || lights[i].Key() == name {
+			return &lights[i], nil
+		}
+	}
+	return lightByName(lights, name)
+}
+
+// targetZones turns the targets into zones of the lights picked by
+// targetLights, in the same order.
+func targetZones(lights []hue.Light, targets []Target, opts *Options) ([]LightZone, error) {
+	zones := make([]LightZone, len(targets))
+	for i, target := range targets {
+		light := lights[i]
+		mode := target.Mode
+		if mode == "" {
+			mode = opts.Mode
+		}
+		if !supportsMode(light, mode) {
+			return nil, fmt.Errorf("%s doesn't support mode %s", light.Name, mode)
+		}
+
+		zones[i] = LightZone{Range: target.keys, Light: light, NoKeys: target.Keys == "", CC: target.CC, Mode: target.Mode}
+		fmt.Printf("✅ %s: %s\n", light.Name, zones[i].describe())
+	}
+	return zones, nil
+}
+
+// describe tells what drives the light of the zone, for display.
+func (z *LightZone) describe() string {
+	var inputs []string
+	if !z.NoKeys {
+		inputs = append(inputs, "keys "+z.Range.String())
+	}
+	if z.CC > 0 {
+		inputs = append(inputs, fmt.Sprintf("CC%d", z.CC))
+	}
+	description := strings.Join(inputs, " and ")
+	if z.Mode != "" {
+		description += " in " + z.Mode + " mode"
+	}
+	return description
+}
+
+// ccZone returns the zone a controller drives on its own, if any.
+func (l *midiListener) ccZone(controller uint8) *LightZone {
+	for i := range l.zones {
+		if l.zones[i].CC > 0 && l.zones[i].CC == int(controller) {
+			return &l.zones[i]
+		}
+	}
+	return nil
+}
+
+// handleZoneCC sets the light of a zone from its controller, as a
+// brightness, hue or color temperature depending on its mode.
+func (l *midiListener) handleZoneCC(zone *LightZone, value uint8) {
+	if l.latched.Load() {
+		return
+	}
+
+	mode := l.lightMode(&zone.Light)
+	var level int
+	switch mode {
+	case ModeColor:
+		level = midimap.CCHue(value)
+	case ModeColorTemp:
+		level = midimap.CCColorTemp(value)
+	default:
+		level = midimap.CCBrightness(value)
+	}
+
+	l.mu.Lock()
+	state := l.levels[zone.Light.Key()]
+	if state.current == level {
+		l.mu.Unlock()
+		return
+	}
+	state.current = level
+	l.mu.Unlock()
+
+	l.applyLevel(&zone.Light, level)
+	slog.Info(fmt.Sprintf("🎛️  CC%d %d → %s%s", zone.CC, value, l.renderLevel(mode, level), l.zoneSuffix([]*hue.Light{&zone.Light})))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSlowdown caps how many times longer the interval gets while the
+	// bridge is rate limiting.
+	maxSlowdown = 8
+	// slowdownRecovery is how long the interval stays stretched before
+	// halving again, as long as the bridge stops complaining.
+	slowdownRecovery = 5 * time.Second
+)
+
+// Throttler coalesces rapid updates per light so the bridge receives at most
+// one command per interval for each light. Intermediate updates are dropped
+// but the latest one is always sent, so the light never gets stuck at a
+// stale value after a fast glissando.
+//
+// Updates get a context canceled when Stop is called, or when a newer
+// update for the same key arrives while they have been running longer than
+// the interval, so that a lagging bridge doesn't keep applying stale
+// values after the user stopped playing.
+type Throttler struct {
+	interval time.Duration
+	onError  func(err error)
+
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu        sync.Mutex
+	pending   map[string]func(ctx context.Context) error
+	active    map[string]bool
+	inflight  map[string]inflightUpdate
+	intervals map[string]time.Duration
+	wg        sync.WaitGroup
+
+	// slowdown multiplies every interval since slowedAt, see SlowDown.
+	slowdown int
+	slowedAt time.Time
+}
+
+// inflightUpdate is an update being sent.
+type inflightUpdate struct {
+	cancel   context.CancelFunc
+	started  time.Time
+	interval time.Duration
+}
+
+// newThrottler returns a Throttler sending at most one update per interval
+// for each key. A zero interval sends every update synchronously.
+func newThrottler(interval time.Duration, onError func(err error)) *Throttler {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Throttler{
+		interval:  interval,
+		onError:   onError,
+		ctx:       ctx,
+		stop:      stop,
+		pending:   make(map[string]func(ctx context.Context) error),
+		active:    make(map[string]bool),
+		inflight:  make(map[string]inflightUpdate),
+		intervals: make(map[string]time.Duration),
+		slowdown:  1,
+	}
+}
+
+// SlowDown doubles every interval, up to maxSlowdown times, for when the
+// bridge says it gets too many requests. The intervals recover on their
+// own, halving every slowdownRecovery without a new call. A zero interval
+// has nothing to stretch and stays synchronous.
+func (t *Throttler) SlowDown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.slowdown = min(t.currentSlowdown()*2, maxSlowdown)
+	t.slowedAt = time.Now()
+}
+
+// currentSlowdown is the slowdown factor left after recovering since the
+// last SlowDown. t.mu must be held.
+func (t *Throttler) currentSlowdown() int {
+	steps := int(time.Since(t.slowedAt) / slowdownRecovery)
+	if steps >= 31 {
+		return 1
+	}
+	return max(t.slowdown>>steps, 1)
+}
+
+// SetInterval overrides the interval for one key, e.g. a group which the
+// bridge only accepts about one command per second for.
+func (t *Throttler) SetInterval(key string, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.intervals[key] = interval
+}
+
+// Send schedules update for the given key (typically a light ID), replacing
+// any update for that key that hasn't been sent yet.
+func (t *Throttler) Send(key string, update func(ctx context.Context) error) {
+	if t.interval <= 0 {
+		if err := update(t.ctx); err != nil && t.ctx.Err() == nil {
+			t.onError(err)
+		}
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[key] = update
+	if t.active[key] {
+		// The update being sent is overdue and already stale
+		if inflight, ok := t.inflight[key]; ok && time.Since(inflight.started) >= inflight.interval {
+			inflight.cancel()
+		}
+		return
+	}
+
+	t.active[key] = true
+	t.wg.Add(1)
+	go t.run(key)
+}
+
+// run sends the pending updates for key, pausing for the interval after
+// each one, and exits once nothing new arrived in the meantime.
+func (t *Throttler) run(key string) {
+	defer t.wg.Done()
+
+	for {
+		t.mu.Lock()
+		update, ok := t.pending[key]
+		if !ok {
+			delete(t.active, key)
+			t.mu.Unlock()
+			return
+		}
+		delete(t.pending, key)
+		interval, ok := t.intervals[key]
+		if !ok {
+			interval = t.interval
+		}
+		interval *= time.Duration(t.currentSlowdown())
+		ctx, cancel := context.WithCancel(t.ctx)
+		start := time.Now()
+		t.inflight[key] = inflightUpdate{cancel: cancel, started: start, interval: interval}
+		t.mu.Unlock()
+
+		if err := update(ctx); err != nil && ctx.Err() == nil {
+			t.onError(err)
+		}
+
+		t.mu.Lock()
+		delete(t.inflight, key)
+		t.mu.Unlock()
+		cancel()
+
+		if wait := interval - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.ctx.Done():
+			}
+		}
+	}
+}
+
+// Stop cancels the updates being sent, drops the pending ones and waits
+// for the senders to return.
+func (t *Throttler) Stop() {
+	t.stop()
+
+	t.mu.Lock()
+	clear(t.pending)
+	t.mu.Unlock()
+
+	t.wg.Wait()
+}